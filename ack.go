@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+//ackMutex protects sentAlerts, lastAlertID, batches, Escalation and batchWindow
+var ackMutex sync.Mutex
+
+//ackButton is attached to every active alert which is not acknowledged yet
+var ackButton = tb.InlineButton{Unique: "ack", Text: "Acknowledge"}
+
+//acknowledger is the source of an alert which can be acknowledged, Metric, LogEvent or remoteSource
+type acknowledger interface {
+	//alertKey identifies the source across reloads and restarts
+	alertKey() string
+	//acknowledge records who acked the alert, re-notification stops until the alert clears
+	acknowledge(by string)
+	//acknowledged returns who acked the active alert, "" if nobody did
+	acknowledged() string
+	//active returns true while the alert has not cleared
+	active() bool
+}
+
+func (metric *Metric) alertKey() string {
+	return metric.name
+}
+
+func (metric *Metric) acknowledge(by string) {
+	metric.Lock()
+	defer metric.Unlock()
+	if metric.lastSeverity != SeverityOK {
+		metric.ackedBy = by
+	}
+}
+
+func (metric *Metric) acknowledged() string {
+	metric.Lock()
+	defer metric.Unlock()
+	return metric.ackedBy
+}
+
+func (metric *Metric) active() bool {
+	metric.Lock()
+	defer metric.Unlock()
+	return metric.lastSeverity != SeverityOK
+}
+
+func (entry *LogEvent) alertKey() string {
+	return entry.key
+}
+
+func (entry *LogEvent) acknowledge(by string) {
+	entry.Lock()
+	defer entry.Unlock()
+	if entry.lastState {
+		entry.ackedBy = by
+	}
+}
+
+func (entry *LogEvent) acknowledged() string {
+	entry.Lock()
+	defer entry.Unlock()
+	return entry.ackedBy
+}
+
+func (entry *LogEvent) active() bool {
+	entry.Lock()
+	defer entry.Unlock()
+	return entry.lastState
+}
+
+//alertSource returns the check, log event or agent's source with the key, nil if it is not configured anymore
+func (monitor *Monitor) alertSource(key string) acknowledger {
+	checksMutex.RLock()
+	defer checksMutex.RUnlock()
+	for _, checks := range []map[string]*Metric{monitor.Checks, monitor.ExtChecks} {
+		if metric, found := checks[key]; found {
+			return metric
+		}
+	}
+	for _, l := range monitor.Logfiles {
+		for k := range l.Events {
+			if l.Events[k].key == key {
+				return &l.Events[k]
+			}
+		}
+	}
+	return monitor.remoteSource(key)
+}
+
+//onAcknowledge handles the Acknowledge button: records who acked and edits the alert for all recipients
+func (monitor *Monitor) onAcknowledge(c *tb.Callback) {
+	if !monitor.isAuthorized(c.Sender) {
+		monitor.bot.Respond(c, &tb.CallbackResponse{Text: "Not authorized."})
+		return
+	}
+	id, _ := strconv.Atoi(c.Data)
+	ackMutex.Lock()
+	sent, found := monitor.sentAlerts[id]
+	if !found {
+		ackMutex.Unlock()
+		monitor.bot.Respond(c, &tb.CallbackResponse{Text: "The alert has cleared"})
+		return
+	}
+	if sent.AckedBy != "" {
+		ackMutex.Unlock()
+		monitor.bot.Respond(c, &tb.CallbackResponse{Text: "Already acknowledged by " + sent.AckedBy})
+		return
+	}
+	by := c.Sender.Username
+	sent.AckedBy = by
+	sent.AckedAt = time.Now()
+	if source := monitor.alertSource(sent.Key); source != nil {
+		source.acknowledge(by)
+	}
+	//all the messages of the alert (repeats and escalations) are edited for all recipients
+	type edit struct {
+		message tb.StoredMessage
+		text    string
+		markup  *tb.ReplyMarkup
+	}
+	var edits []edit
+	for _, b := range monitor.batches {
+		if b.contains(id) {
+			text, markup := monitor.render(b.Items)
+			edits = append(edits, edit{b.Message, text, markup})
+		}
+	}
+	monitor.saveSentAlerts()
+	ackMutex.Unlock()
+	logTelegram.Infof("Alert acknowledged by %s: %s", by, sent.Text)
+	for _, e := range edits {
+		var err error
+		if e.markup != nil {
+			_, err = monitor.bot.Edit(e.message, e.text, e.markup)
+		} else {
+			//editing without the markup removes the buttons
+			_, err = monitor.bot.Edit(e.message, e.text)
+		}
+		if err != nil {
+			logTelegram.Warnf("Error editing acknowledged alert: %s", err)
+		}
+	}
+	monitor.bot.Respond(c, &tb.CallbackResponse{Text: "Acknowledged"})
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+//ADNL over TCP is the transport of the lite server and of the validator engine control interface
+
+const (
+	adnlTimeout   = 30 * time.Second //the whole connection, if the context has no deadline
+	adnlMaxPacket = 1 << 24
+
+	tlPubEd25519    = 0x4813b4c6 //pub.ed25519 key:int256 = PublicKey
+	tlPrivEd25519   = 0x49682317 //pk.ed25519 key:int256 = PrivateKey
+	tlADNLQuery     = 0xb48bf97a //adnl.message.query query_id:int256 query:bytes = adnl.Message
+	tlADNLAnswer    = 0x0fac8416 //adnl.message.answer query_id:int256 answer:bytes = adnl.Message
+	tlAuthenticate  = 0x445bab12 //tcp.authentificate nonce:bytes = tcp.Message
+	tlAuthNonce     = 0xe35d4ab6 //tcp.authentificationNonce nonce:bytes = tcp.Message
+	tlAuthComplete  = 0xf7ad9ea6 //tcp.authentificationComplete key:PublicKey signature:bytes = tcp.Message
+	adnlMaxAuthWait = 16         //packets received while waiting for the authentication nonce
+)
+
+//tlWriter serializes TL values, all numbers are little endian
+type tlWriter struct{ bytes.Buffer }
+
+func (w *tlWriter) uint32(v uint32) {
+	binary.Write(&w.Buffer, binary.LittleEndian, v)
+}
+
+func (w *tlWriter) int64(v int64) {
+	binary.Write(&w.Buffer, binary.LittleEndian, v)
+}
+
+func (w *tlWriter) bytes(b []byte) {
+	//a short length is 1 byte, a long one is 0xfe and 3 bytes, the whole is padded to 4 bytes
+	n := len(b) + 1
+	if len(b) < 254 {
+		w.WriteByte(byte(len(b)))
+	} else {
+		w.Write([]byte{254, byte(len(b)), byte(len(b) >> 8), byte(len(b) >> 16)})
+		n += 3
+	}
+	w.Write(b)
+	for ; n%4 != 0; n++ {
+		w.WriteByte(0)
+	}
+}
+
+//tlReader deserializes TL values, the first error is kept in err and zero values are returned after it
+type tlReader struct {
+	data []byte
+	err  error
+}
+
+func (r *tlReader) next(n int) []byte {
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	if len(r.data) < n {
+		r.err = fmt.Errorf("TL: unexpected end of data")
+		return make([]byte, n)
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *tlReader) uint32() uint32 {
+	return binary.LittleEndian.Uint32(r.next(4))
+}
+
+func (r *tlReader) int32() int32 {
+	return int32(r.uint32())
+}
+
+func (r *tlReader) int64() int64 {
+	return int64(binary.LittleEndian.Uint64(r.next(8)))
+}
+
+func (r *tlReader) int256() (v [32]byte) {
+	copy(v[:], r.next(32))
+	return
+}
+
+func (r *tlReader) bytes() []byte {
+	n, header := int(r.next(1)[0]), 1
+	if n == 254 {
+		l := r.next(3)
+		n, header = int(l[0])|int(l[1])<<8|int(l[2])<<16, 4
+	}
+	b := r.next(n)
+	r.next((4 - (header+n)%4) % 4)
+	return b
+}
+
+//readPublicKey reads an ed25519 public key from a file with a TL-serialized key (liteserver.pub, server.pub) or a raw one
+func readPublicKey(file string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 36 && binary.LittleEndian.Uint32(data) == tlPubEd25519 {
+		data = data[4:]
+	}
+	if len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s is not an ed25519 public key", file)
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+//readPrivateKey reads an ed25519 private key from a file with a TL-serialized key (client) or a raw seed
+func readPrivateKey(file string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 36 && binary.LittleEndian.Uint32(data) == tlPrivEd25519 {
+		data = data[4:]
+	}
+	if len(data) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", file)
+	}
+	return ed25519.NewKeyFromSeed(data), nil
+}
+
+//keyID is the short ID of a public key: sha256 of the TL-serialized key
+func keyID(key ed25519.PublicKey) []byte {
+	var w tlWriter
+	w.uint32(tlPubEd25519)
+	w.Write(key)
+	id := sha256.Sum256(w.Bytes())
+	return id[:]
+}
+
+//sharedSecret is x25519 of the ed25519 keys
+func sharedSecret(private ed25519.PrivateKey, public ed25519.PublicKey) ([]byte, error) {
+	//the Montgomery u of the Edwards y: (1 + y) / (1 - y)
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	le := make([]byte, 32)
+	for i := range le {
+		le[i] = public[31-i]
+	}
+	le[0] &= 0x7f
+	y := new(big.Int).SetBytes(le)
+	one := big.NewInt(1)
+	denominator := new(big.Int).Sub(one, y)
+	denominator.Mod(denominator, p)
+	if denominator.Sign() == 0 {
+		return nil, fmt.Errorf("Invalid public key")
+	}
+	u := new(big.Int).Add(one, y)
+	u.Mul(u, denominator.ModInverse(denominator, p))
+	u.Mod(u, p)
+	uBytes := make([]byte, 32)
+	be := u.Bytes()
+	for i, b := range be {
+		uBytes[len(be)-1-i] = b
+	}
+	//the x25519 scalar of an ed25519 key is the first half of sha512 of its seed, clamped by X25519
+	h := sha512.Sum512(private.Seed())
+	return curve25519.X25519(h[:32], uBytes)
+}
+
+func aesCTR(key []byte, iv []byte) cipher.Stream {
+	block, _ := aes.NewCipher(key)
+	return cipher.NewCTR(block, iv)
+}
+
+//adnlConn is an ADNL over TCP connection to a server
+type adnlConn struct {
+	conn   net.Conn
+	reader cipher.Stream
+	writer cipher.Stream
+}
+
+//dialADNL connects and does the handshake, the connection is closed when ctx's deadline (adnlTimeout if none) is reached
+func dialADNL(ctx context.Context, addr string, serverKey ed25519.PublicKey) (c *adnlConn, err error) {
+	deadline, found := ctx.Deadline()
+	if !found {
+		deadline = time.Now().Add(adnlTimeout)
+	}
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(deadline)
+	//the ciphers of the session are made of 160 random bytes, sent encrypted with the server's key
+	params := make([]byte, 160)
+	rand.Read(params)
+	c = &adnlConn{conn: conn, reader: aesCTR(params[:32], params[64:80]), writer: aesCTR(params[32:64], params[80:96])}
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	secret, err := sharedSecret(private, serverKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	hash := sha256.Sum256(params)
+	key := append(append([]byte{}, secret[:16]...), hash[16:]...)
+	iv := append(append([]byte{}, hash[:4]...), secret[20:]...)
+	encrypted := make([]byte, len(params))
+	aesCTR(key, iv).XORKeyStream(encrypted, params)
+	var handshake bytes.Buffer
+	handshake.Write(keyID(serverKey))
+	handshake.Write(private.Public().(ed25519.PublicKey))
+	handshake.Write(hash[:])
+	handshake.Write(encrypted)
+	_, err = conn.Write(handshake.Bytes())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	//the server confirms the handshake with an empty packet
+	_, err = c.receive()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("ADNL handshake with %s failed: %s", addr, err)
+	}
+	return
+}
+
+func (c *adnlConn) Close() error {
+	return c.conn.Close()
+}
+
+//send sends a packet: length, nonce, payload and sha256 of nonce and payload, all encrypted
+func (c *adnlConn) send(payload []byte) (err error) {
+	packet := make([]byte, 4+32+len(payload)+32)
+	binary.LittleEndian.PutUint32(packet, uint32(len(packet)-4))
+	rand.Read(packet[4:36])
+	copy(packet[36:], payload)
+	hash := sha256.Sum256(packet[4 : 36+len(payload)])
+	copy(packet[36+len(payload):], hash[:])
+	c.writer.XORKeyStream(packet, packet)
+	_, err = c.conn.Write(packet)
+	return
+}
+
+//receive returns the payload of the next packet
+func (c *adnlConn) receive() (payload []byte, err error) {
+	header := make([]byte, 4)
+	_, err = io.ReadFull(c.conn, header)
+	if err != nil {
+		return
+	}
+	c.reader.XORKeyStream(header, header)
+	size := binary.LittleEndian.Uint32(header)
+	if size < 64 || size > adnlMaxPacket {
+		return nil, fmt.Errorf("Invalid ADNL packet size %d", size)
+	}
+	packet := make([]byte, size)
+	_, err = io.ReadFull(c.conn, packet)
+	if err != nil {
+		return
+	}
+	c.reader.XORKeyStream(packet, packet)
+	hash := sha256.Sum256(packet[:size-32])
+	if !bytes.Equal(hash[:], packet[size-32:]) {
+		return nil, fmt.Errorf("Invalid ADNL packet checksum")
+	}
+	return packet[32 : size-32], nil
+}
+
+//authenticate proves the client owns the key: it signs its nonce followed by the server's one
+func (c *adnlConn) authenticate(key ed25519.PrivateKey) (err error) {
+	nonce := make([]byte, 32)
+	rand.Read(nonce)
+	var w tlWriter
+	w.uint32(tlAuthenticate)
+	w.bytes(nonce)
+	err = c.send(w.Bytes())
+	if err != nil {
+		return
+	}
+	for i := 0; ; i++ {
+		if i == adnlMaxAuthWait {
+			return fmt.Errorf("No authentication nonce from the server")
+		}
+		payload, err := c.receive()
+		if err != nil {
+			return err
+		}
+		r := tlReader{data: payload}
+		if len(payload) < 4 || r.uint32() != tlAuthNonce {
+			continue
+		}
+		serverNonce := r.bytes()
+		if r.err != nil {
+			return r.err
+		}
+		w.Reset()
+		w.uint32(tlAuthComplete)
+		w.uint32(tlPubEd25519)
+		w.Write(key.Public().(ed25519.PublicKey))
+		w.bytes(ed25519.Sign(key, append(nonce, serverNonce...)))
+		return c.send(w.Bytes())
+	}
+}
+
+//query sends an ADNL query and waits for its answer
+func (c *adnlConn) query(q []byte) (answer []byte, err error) {
+	queryID := make([]byte, 32)
+	rand.Read(queryID)
+	var w tlWriter
+	w.uint32(tlADNLQuery)
+	w.Write(queryID)
+	w.bytes(q)
+	err = c.send(w.Bytes())
+	if err != nil {
+		return
+	}
+	for {
+		payload, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		//skip empty packets and anything but the answer
+		r := tlReader{data: payload}
+		if len(payload) < 36 || r.uint32() != tlADNLAnswer {
+			continue
+		}
+		id := r.int256()
+		if !bytes.Equal(id[:], queryID) {
+			continue
+		}
+		answer = r.bytes()
+		return answer, r.err
+	}
+}
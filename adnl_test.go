@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"testing"
+)
+
+func TestTLBytes(t *testing.T) {
+	tests := []struct {
+		n      int
+		length int //serialized length with the padding
+	}{
+		{0, 4},
+		{1, 4},
+		{3, 4},
+		{4, 8},
+		{253, 256},
+		{254, 260},
+		{300, 304},
+		{70000, 70004},
+	}
+	for _, test := range tests {
+		b := make([]byte, test.n)
+		for i := range b {
+			b[i] = byte(i + 1)
+		}
+		var w tlWriter
+		w.bytes(b)
+		w.uint32(0xdeadbeef)
+		if w.Len() != test.length+4 {
+			t.Errorf("%d bytes are serialized in %d, want %d", test.n, w.Len()-4, test.length)
+			continue
+		}
+		r := &tlReader{data: w.Bytes()}
+		if got := r.bytes(); !bytes.Equal(got, b) {
+			t.Errorf("%d bytes are read as %d", test.n, len(got))
+		}
+		if v := r.uint32(); v != 0xdeadbeef || r.err != nil || len(r.data) != 0 {
+			t.Errorf("%d bytes: the next value is %x, %v", test.n, v, r.err)
+		}
+	}
+}
+
+func TestTLReader(t *testing.T) {
+	var w tlWriter
+	w.uint32(0x12345678)
+	w.int64(-2)
+	w.Write(bytes.Repeat([]byte{7}, 32))
+	r := &tlReader{data: w.Bytes()}
+	if v := r.int32(); v != 0x12345678 {
+		t.Errorf("int32 = %x", v)
+	}
+	if v := r.int64(); v != -2 {
+		t.Errorf("int64 = %d", v)
+	}
+	if v := r.int256(); v[0] != 7 || v[31] != 7 || r.err != nil {
+		t.Errorf("int256 = %x, %v", v, r.err)
+	}
+	//the first error is kept and zero values are returned after it
+	if v := r.uint32(); v != 0 || r.err == nil {
+		t.Errorf("uint32 past the end = %x, %v", v, r.err)
+	}
+	r = &tlReader{data: []byte{254, 0, 1}}
+	if r.bytes(); r.err == nil {
+		t.Errorf("no error for a truncated length")
+	}
+	r = &tlReader{data: []byte{5, 1, 2, 3}}
+	if r.bytes(); r.err == nil {
+		t.Errorf("no error for truncated bytes")
+	}
+}
+
+func TestSharedSecret(t *testing.T) {
+	decode := func(s string) []byte {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	tests := []struct {
+		seed   string
+		public string
+		secret string
+	}{
+		//the keys of the RFC 8032 test vectors 1 and 2, in both directions
+		{
+			"9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60",
+			"3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c",
+			"5166f24a6918368e2af831a4affadd97af0ac326bdf143596c045967cc00230e",
+		},
+		{
+			"4ccd089b28ff96da9db6c346ec114e0f5b8a319f35aba624da8cf6ed4fb8a6fb",
+			"d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a",
+			"5166f24a6918368e2af831a4affadd97af0ac326bdf143596c045967cc00230e",
+		},
+		//computed with the ADNL key exchange of tonutils-go
+		{
+			"af2e8ac27c64e255582cc49f82a7df177de791b168abbdfc108f6ced6320680a",
+			"9f85439d2094b92a639c2c9493d7b740e39dea8d08b525986d39d6dd69e7f309",
+			"dcb72ec1d56a9506c5074be46cf7d87ec23bfa33bf1311ddbd56e49fe2df8777",
+		},
+	}
+	for _, test := range tests {
+		secret, err := sharedSecret(ed25519.NewKeyFromSeed(decode(test.seed)), ed25519.PublicKey(decode(test.public)))
+		if err != nil {
+			t.Errorf("%s: %s", test.public, err)
+			continue
+		}
+		if hex.EncodeToString(secret) != test.secret {
+			t.Errorf("%s: secret = %x, want %s", test.public, secret, test.secret)
+		}
+	}
+	//y = 1 has no Montgomery u
+	one := make([]byte, 32)
+	one[0] = 1
+	if _, err := sharedSecret(ed25519.NewKeyFromSeed(make([]byte, 32)), ed25519.PublicKey(one)); err == nil {
+		t.Errorf("no error for an invalid public key")
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	agentHeartbeat  = 30 * time.Second
+	agentIOTimeout  = 10 * time.Second
+	agentMaxBackoff = time.Minute
+	agentQueueSize  = 1000 //alerts kept while the server is unreachable, the oldest non-critical ones are dropped
+	agentMaxHello   = 4096 //bytes read from a connection before the agent is authenticated
+)
+
+//Agent runs the checks and log tails and streams alerts to the server instead of telegram
+type Agent struct {
+	Server string //"monitor.example.com:7010"
+	Name   string //the agent's name on the server, the hostname if empty
+	Token  string //the agent's token in Server.Agents
+	CA     string //PEM file of the CA which signed the server certificate, the system roots if empty
+	name   string
+	tls    *tls.Config
+}
+
+//agentMessage is a line of JSON exchanged by the agent and the server
+type agentMessage struct {
+	Type   string      //"hello", "alert", "heartbeat" from the agent, "ack" or "error" from the server
+	Name   string      `json:",omitempty"` //hello
+	Token  string      `json:",omitempty"` //hello
+	Alert  *agentAlert `json:",omitempty"` //alert
+	Status []string    `json:",omitempty"` //heartbeat: as reported by /status
+	Checks []string    `json:",omitempty"` //heartbeat: check names, to mute them on the server
+	Active []string    `json:",omitempty"` //heartbeat: keys of the active alerts
+	Key    string      `json:",omitempty"` //ack
+	By     string      `json:",omitempty"` //ack
+	Error  string      `json:",omitempty"` //error
+}
+
+//agentAlert is an Alert sent by the agent, Key is alertKey() of the source, "" if it can't be acknowledged
+type agentAlert struct {
+	Check    string
+	Category string
+	Severity Severity
+	Text     string
+	Key      string `json:",omitempty"`
+}
+
+func (a *Agent) parse() (err error) {
+	if a.Server == "" {
+		return fmt.Errorf("Agent Server is empty")
+	}
+	if a.Token == "" {
+		return fmt.Errorf("Agent Token is empty")
+	}
+	//the agent would never connect with a bad Server or CA, it refuses to start instead
+	a.tls, err = a.tlsConfig()
+	return
+}
+
+//tlsConfig returns the client TLS config of the agent
+func (a *Agent) tlsConfig() (config *tls.Config, err error) {
+	host, _, err := net.SplitHostPort(a.Server)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Agent Server %s: %s", a.Server, err)
+	}
+	config = &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	if a.CA != "" {
+		pem, err := ioutil.ReadFile(a.CA)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading Agent CA: %s", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in Agent CA %s", a.CA)
+		}
+	}
+	return
+}
+
+//heartbeat reports the status and active alerts of the agent
+func (monitor *Monitor) heartbeat() *agentMessage {
+	m := &agentMessage{Type: "heartbeat", Status: monitor.statusMessages()}
+	checksMutex.RLock()
+	defer checksMutex.RUnlock()
+	for _, checks := range []map[string]*Metric{monitor.Checks, monitor.ExtChecks} {
+		for name, metric := range checks {
+			m.Checks = append(m.Checks, name)
+			if metric.active() {
+				m.Active = append(m.Active, metric.alertKey())
+			}
+		}
+	}
+	for _, l := range monitor.Logfiles {
+		for k := range l.Events {
+			if l.Events[k].active() {
+				m.Active = append(m.Active, l.Events[k].alertKey())
+			}
+		}
+	}
+	return m
+}
+
+//agentConn is a connection of the agent to the server
+type agentConn struct {
+	conn    net.Conn
+	encoder *json.Encoder
+	closed  chan struct{} //closed when the connection fails
+	once    sync.Once
+}
+
+func (c *agentConn) send(m *agentMessage) (err error) {
+	c.conn.SetWriteDeadline(time.Now().Add(agentIOTimeout))
+	err = c.encoder.Encode(m)
+	if err != nil {
+		c.close()
+	}
+	return
+}
+
+func (c *agentConn) close() {
+	c.once.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+//connectAgent connects to the server, authenticates and starts reading acknowledgements from it
+func (monitor *Monitor) connectAgent(config *tls.Config) (c *agentConn, err error) {
+	dialer := &net.Dialer{Timeout: agentIOTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", monitor.Agent.Server, config)
+	if err != nil {
+		return
+	}
+	c = &agentConn{conn: conn, encoder: json.NewEncoder(conn), closed: make(chan struct{})}
+	err = c.send(&agentMessage{Type: "hello", Name: monitor.Agent.name, Token: monitor.Agent.Token})
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		defer c.close()
+		decoder := json.NewDecoder(conn)
+		for {
+			//the server sends nothing but acknowledgements, there is no read deadline
+			var m agentMessage
+			if err := decoder.Decode(&m); err != nil {
+				select {
+				case <-c.closed:
+				default:
+					logMain.Warnf("Connection to the server is lost: %s", err)
+				}
+				return
+			}
+			switch m.Type {
+			case "ack":
+				if source := monitor.alertSource(m.Key); source != nil {
+					source.acknowledge(m.By)
+					monitor.saveState()
+					logMain.Infof("Alert %s acknowledged by %s", m.Key, m.By)
+				}
+			case "error":
+				logMain.Errorf("Server refused the connection: %s", m.Error)
+			}
+		}
+	}()
+	return
+}
+
+//agentForwarder sends alerts to the server until prQueue is closed, it replaces msgDispatcher in agent mode.
+//Alerts are kept in memory while the server is unreachable
+func (monitor *Monitor) agentForwarder() {
+	agentLog := logMain.With("server", monitor.Agent.Server)
+	config := monitor.Agent.tls
+	var err error
+	var pending []*agentMessage
+	var c *agentConn
+	var deadline, connected time.Time
+	backoff := time.Second
+	retry := time.Now()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastHeartbeat := time.Time{}
+	prQueue := monitor.prQueue
+	for {
+		now := time.Now()
+		if c == nil && !now.Before(retry) {
+			c, err = monitor.connectAgent(config)
+			if err != nil {
+				c = nil
+				agentLog.Warnf("Error connecting to the server, retry in %s: %s", backoff, err)
+			} else {
+				agentLog.Infof("Connected to the server")
+				connected = now
+				lastHeartbeat = time.Time{}
+			}
+			//the server may close the connection right away, e.g. if the token is wrong
+			retry = now.Add(backoff)
+			backoff *= 2
+			if backoff > agentMaxBackoff {
+				backoff = agentMaxBackoff
+			}
+		}
+		if c != nil {
+			if now.Sub(lastHeartbeat) >= agentHeartbeat {
+				if c.send(monitor.heartbeat()) == nil {
+					lastHeartbeat = now
+				}
+			}
+			for len(pending) > 0 && c.send(pending[0]) == nil {
+				pending = pending[1:]
+			}
+			select {
+			case <-c.closed:
+				c = nil
+				if now.Sub(connected) > agentMaxBackoff {
+					backoff = time.Second
+					retry = now
+				}
+			default:
+			}
+		}
+		if prQueue == nil && (len(pending) == 0 || now.After(deadline)) {
+			if c != nil {
+				c.close()
+			}
+			if len(pending) > 0 {
+				agentLog.Warnf("%d alerts were not sent to the server", len(pending))
+			}
+			return
+		}
+		var closed chan struct{}
+		if c != nil {
+			closed = c.closed
+		}
+		select {
+		case alert, ok := <-prQueue:
+			if !ok {
+				prQueue = nil
+				deadline = time.Now().Add(drainTimeout)
+				continue
+			}
+			m := &agentMessage{Type: "alert", Alert: &agentAlert{Check: alert.Check, Category: alert.Category, Severity: alert.Severity, Text: alert.Text}}
+			if alert.source != nil {
+				m.Alert.Key = alert.source.alertKey()
+			}
+			pending = append(pending, m)
+			if len(pending) > agentQueueSize {
+				drop := 0
+				for i, p := range pending {
+					if p.Alert.Severity != SeverityCritical {
+						drop = i
+						break
+					}
+				}
+				agentLog.Warnf("Server is unreachable, dropped: %s", pending[drop].Alert.Text)
+				pending = append(pending[:drop], pending[drop+1:]...)
+			}
+		case <-closed:
+		case <-ticker.C:
+		}
+	}
+}
+
+//runAgent runs the checks and log tails, forwarding alerts to the server, until SIGINT or SIGTERM
+func (monitor *Monitor) runAgent(ctx context.Context, cancel context.CancelFunc, signals chan os.Signal) {
+	monitor.Agent.name = monitor.Agent.Name
+	if monitor.Agent.name == "" {
+		monitor.Agent.name = monitor.hostname
+	}
+	logMain.Infof("Running as agent %s of %s", monitor.Agent.name, monitor.Agent.Server)
+	forwarded := make(chan struct{})
+	go func() {
+		monitor.agentForwarder()
+		close(forwarded)
+	}()
+	monitor.start(ctx)
+	monitor.waitForStop(ctx, signals)
+	cancel()
+	monitor.stopHTTP()
+	wg.Wait()
+	monitor.saveState()
+	monitor.closeQueue()
+	<-forwarded
+	logMain.Infof("Stopped")
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//agentCheck is the check name of alerts sent when an agent stops reporting
+const agentCheck = "Agent"
+
+//agentsMutex protects agents and their alert sources
+var agentsMutex sync.Mutex
+
+//Server aggregates agents: their alerts are sent to subscribers of this bot, prefixed with the agent's name
+type Server struct {
+	Listen  string            //e.g. ":7010"
+	Cert    string            //PEM certificate of the server
+	Key     string            //PEM private key of the certificate
+	Agents  map[string]string //agent name -> token
+	Timeout string            //Go duration, an agent which has not reported for it is alerted on, 2m if not set
+	timeout time.Duration
+}
+
+//remoteAgent is the state of an agent, kept across its connections
+type remoteAgent struct {
+	name     string
+	conn     net.Conn //nil if not connected
+	out      chan *agentMessage
+	lastSeen time.Time
+	down     bool
+	status   []string
+	checks   []string
+	sources  map[string]*remoteSource
+}
+
+//remoteSource is an alert source of an agent, it can be acknowledged
+type remoteSource struct {
+	agent   *remoteAgent
+	key     string //alertKey() on the agent
+	isOn    bool
+	ackedBy string
+}
+
+func (s *Server) parse() (err error) {
+	if s.Listen == "" || s.Cert == "" || s.Key == "" {
+		return fmt.Errorf("Server Listen, Cert and Key are required")
+	}
+	if len(s.Agents) == 0 {
+		return fmt.Errorf("Server Agents are empty")
+	}
+	for name, token := range s.Agents {
+		if token == "" {
+			return fmt.Errorf("Token of agent %s is empty", name)
+		}
+	}
+	s.timeout = 2 * time.Minute
+	if s.Timeout != "" {
+		s.timeout, err = time.ParseDuration(s.Timeout)
+		if err != nil || s.timeout <= 0 {
+			return fmt.Errorf("Invalid Server Timeout %q", s.Timeout)
+		}
+	}
+	return
+}
+
+func (source *remoteSource) alertKey() string {
+	return source.agent.name + "/" + source.key
+}
+
+//acknowledge is passed to the agent to stop its re-notifications
+func (source *remoteSource) acknowledge(by string) {
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+	if !source.isOn {
+		return
+	}
+	source.ackedBy = by
+	if source.agent.out != nil {
+		select {
+		case source.agent.out <- &agentMessage{Type: "ack", Key: source.key, By: by}:
+		default:
+		}
+	}
+}
+
+func (source *remoteSource) acknowledged() string {
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+	return source.ackedBy
+}
+
+func (source *remoteSource) active() bool {
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+	return source.isOn
+}
+
+//setActive records the state of the source reported by the agent, agentsMutex has to be locked
+func (source *remoteSource) setActive(active bool) {
+	source.isOn = active
+	if !active {
+		source.ackedBy = ""
+	}
+}
+
+//remoteAgent returns the state of the configured agent, nil if it is not configured. agentsMutex has to be locked
+func (monitor *Monitor) remoteAgent(name string) *remoteAgent {
+	if _, found := monitor.Server.Agents[name]; !found {
+		return nil
+	}
+	a, found := monitor.agents[name]
+	if !found {
+		a = &remoteAgent{name: name, lastSeen: time.Now(), sources: make(map[string]*remoteSource)}
+		monitor.agents[name] = a
+	}
+	return a
+}
+
+func (a *remoteAgent) source(key string) *remoteSource {
+	s, found := a.sources[key]
+	if !found {
+		s = &remoteSource{agent: a, key: key}
+		a.sources[key] = s
+	}
+	return s
+}
+
+//remoteSource returns the source of an agent's alert by alertKey(), nil if it is not an agent's alert
+func (monitor *Monitor) remoteSource(key string) acknowledger {
+	if monitor.Server == nil {
+		return nil
+	}
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+	for name := range monitor.Server.Agents {
+		if strings.HasPrefix(key, name+"/") {
+			return monitor.remoteAgent(name).source(strings.TrimPrefix(key, name+"/"))
+		}
+	}
+	return nil
+}
+
+//agentChecks returns check names reported by the agents
+func (monitor *Monitor) agentChecks() (checks []string) {
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+	for _, a := range monitor.agents {
+		checks = append(checks, a.checks...)
+	}
+	return
+}
+
+//agentStatus returns the status lines of the agents prefixed with their names, for /status
+func (monitor *Monitor) agentStatus() (lines []string) {
+	if monitor.Server == nil {
+		return
+	}
+	agentsMutex.Lock()
+	defer agentsMutex.Unlock()
+	var names []string
+	for name := range monitor.Server.Agents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		a := monitor.remoteAgent(name)
+		if a.down {
+			lines = append(lines, fmt.Sprintf("%s: not reporting since %s", name, a.lastSeen.Format(time.RFC3339)))
+			continue
+		}
+		for _, s := range a.status {
+			lines = append(lines, name+": "+s)
+		}
+	}
+	return
+}
+
+//serveAgents accepts connections of the agents until ctx is done
+func (monitor *Monitor) serveAgents(ctx context.Context) (err error) {
+	cert, err := tls.LoadX509KeyPair(monitor.Server.Cert, monitor.Server.Key)
+	if err != nil {
+		return
+	}
+	listener, err := tls.Listen("tcp", monitor.Server.Listen, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12})
+	if err != nil {
+		return
+	}
+	logMain.Infof("Listening for agents on %s", listener.Addr())
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+		agentsMutex.Lock()
+		for _, a := range monitor.agents {
+			if a.conn != nil {
+				a.conn.Close()
+			}
+		}
+		agentsMutex.Unlock()
+	}()
+	wg.Add(2)
+	go monitor.watchAgents(ctx)
+	go func() {
+		defer wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					logMain.Errorf("Error accepting agents: %s", err)
+				}
+				return
+			}
+			wg.Add(1)
+			go monitor.handleAgent(ctx, conn)
+		}
+	}()
+	return
+}
+
+//handleAgent authenticates the agent and queues its alerts until the connection is closed
+func (monitor *Monitor) handleAgent(ctx context.Context, conn net.Conn) {
+	defer wg.Done()
+	defer conn.Close()
+	agentLog := logMain.With("agent", conn.RemoteAddr().String())
+	//the hello is read with a limit, it is lifted when the agent is authenticated
+	limited := &io.LimitedReader{R: conn, N: agentMaxHello}
+	decoder := json.NewDecoder(limited)
+	encoder := json.NewEncoder(conn)
+	conn.SetDeadline(time.Now().Add(agentIOTimeout))
+	var hello agentMessage
+	err := decoder.Decode(&hello)
+	if err != nil {
+		agentLog.Warnf("Error reading hello: %s", err)
+		return
+	}
+	token := monitor.Server.Agents[hello.Name]
+	if hello.Type != "hello" || token == "" || subtle.ConstantTimeCompare([]byte(hello.Token), []byte(token)) != 1 {
+		agentLog.Warnf("Agent %s is not authorized", hello.Name)
+		encoder.Encode(&agentMessage{Type: "error", Error: "Not authorized"})
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	limited.N = math.MaxInt64
+	agentLog = logMain.With("agent", hello.Name)
+	agentLog.Infof("Agent connected from %s", conn.RemoteAddr())
+	out := make(chan *agentMessage, 100)
+	agentsMutex.Lock()
+	a := monitor.remoteAgent(hello.Name)
+	if a.conn != nil {
+		//the agent has reconnected, the old connection is dead
+		a.conn.Close()
+	}
+	a.conn = conn
+	a.out = out
+	agentsMutex.Unlock()
+	defer func() {
+		agentsMutex.Lock()
+		if a.conn == conn {
+			a.conn = nil
+			a.out = nil
+		}
+		agentsMutex.Unlock()
+		close(out)
+		agentLog.Infof("Agent disconnected")
+	}()
+	go func() {
+		for m := range out {
+			conn.SetWriteDeadline(time.Now().Add(agentIOTimeout))
+			if encoder.Encode(m) != nil {
+				conn.Close()
+			}
+		}
+	}()
+	for {
+		//an agent sends heartbeats, a connection which is silent for longer is dead
+		conn.SetReadDeadline(time.Now().Add(3 * agentHeartbeat))
+		var m agentMessage
+		err := decoder.Decode(&m)
+		if err != nil {
+			if ctx.Err() == nil {
+				agentLog.Warnf("Connection is lost: %s", err)
+			}
+			return
+		}
+		var alerts []Alert
+		agentsMutex.Lock()
+		a.lastSeen = time.Now()
+		if a.down {
+			a.down = false
+			alerts = append(alerts, Alert{Check: agentCheck, Category: "AGENT", Severity: SeverityOK, Text: "Agent is reporting again", Host: a.name})
+		}
+		switch m.Type {
+		case "alert":
+			if m.Alert == nil {
+				break
+			}
+			alert := Alert{Check: m.Alert.Check, Category: m.Alert.Category, Severity: m.Alert.Severity, Text: m.Alert.Text, Host: a.name}
+			if m.Alert.Key != "" {
+				source := a.source(m.Alert.Key)
+				source.setActive(m.Alert.Severity != SeverityOK)
+				alert.source = source
+			}
+			alerts = append(alerts, alert)
+		case "heartbeat":
+			a.status = m.Status
+			a.checks = m.Checks
+			active := make(map[string]bool, len(m.Active))
+			for _, key := range m.Active {
+				active[key] = true
+			}
+			for key, source := range a.sources {
+				source.setActive(active[key])
+			}
+			for _, key := range m.Active {
+				a.source(key).setActive(true)
+			}
+		}
+		agentsMutex.Unlock()
+		for _, alert := range alerts {
+			monitor.queue(alert)
+		}
+	}
+}
+
+//watchAgents alerts on agents which stopped reporting
+func (monitor *Monitor) watchAgents(ctx context.Context) {
+	defer wg.Done()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			var alerts []Alert
+			agentsMutex.Lock()
+			for name := range monitor.Server.Agents {
+				a := monitor.remoteAgent(name)
+				if !a.down && now.Sub(a.lastSeen) >= monitor.Server.timeout {
+					a.down = true
+					text := fmt.Sprintf("Agent stopped reporting, last seen %s ago", now.Sub(a.lastSeen).Round(time.Second))
+					alerts = append(alerts, Alert{Check: agentCheck, Category: "AGENT", Severity: SeverityCritical, Text: text, Host: name})
+				}
+			}
+			agentsMutex.Unlock()
+			for _, alert := range alerts {
+				logMain.With("agent", alert.Host).Warnf("%s", alert.Text)
+				monitor.queue(alert)
+			}
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+//Severity of an alert, higher is worse
+type Severity int
+
+const (
+	SeverityOK Severity = iota
+	SeverityWarning
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "WARNING"
+	case SeverityCritical:
+		return "CRITICAL"
+	}
+	return "OK"
+}
+
+//parseSeverity parses "warning" or "critical", "" means SeverityOK (no prefix)
+func parseSeverity(s string) (severity Severity, err error) {
+	switch strings.ToLower(s) {
+	case "", "ok":
+		severity = SeverityOK
+	case "warning":
+		severity = SeverityWarning
+	case "critical":
+		severity = SeverityCritical
+	default:
+		err = fmt.Errorf("Unknown severity %s", s)
+	}
+	return
+}
+
+//logsCheck is the check name of alerts sent for log events
+const logsCheck = "Logs"
+
+//Alert is a message passed through prQueue
+type Alert struct {
+	Check    string //name of the check which sent the alert, logsCheck for log events
+	Category string //e.g. CPU, DISK, LOGS
+	Severity Severity
+	Text     string
+	Host     string       //agent which sent the alert, "" for this host
+	source   acknowledger //nil if the alert can't be acknowledged
+}
+
+//String formats the alert as "CATEGORY: SEVERITY: text", OK alerts have no severity prefix
+func (alert Alert) String() string {
+	var b strings.Builder
+	if alert.Category != "" {
+		b.WriteString(alert.Category + ": ")
+	}
+	if alert.Severity != SeverityOK {
+		b.WriteString(alert.Severity.String() + ": ")
+	}
+	b.WriteString(alert.Text)
+	return b.String()
+}
+
+//activeFor suffixes a repeated alert with the time it has been active
+func activeFor(message string, since time.Time) string {
+	return fmt.Sprintf("%s (active for %s)", message, time.Since(since).Round(time.Second))
+}
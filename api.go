@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//apiCheck is a check in the /status document
+type apiCheck struct {
+	Name           string
+	Category       string
+	Enabled        bool
+	Value          *float64   `json:",omitempty"` //not measured since start if nil
+	Updated        *time.Time `json:",omitempty"`
+	Warning        *float64   `json:",omitempty"`
+	Critical       float64
+	Severity       string     //reported to subscribers: "OK", "WARNING" or "CRITICAL"
+	AlertSince     *time.Time `json:",omitempty"`
+	Message        string     //the last alert or recovery sent
+	Status         string     //as reported by the /status command
+	Failing        bool
+	Failure        string `json:",omitempty"`
+	AcknowledgedBy string `json:",omitempty"`
+	Muted          bool
+}
+
+//apiLogEvent is a log event in the /status document
+type apiLogEvent struct {
+	File           string
+	Match          string
+	Enabled        bool
+	Threshold      int
+	Window         int    //minutes
+	Count          int    //events within Window
+	Matches        uint64 //lines matched since start
+	Alert          bool
+	AlertSince     *time.Time `json:",omitempty"`
+	AcknowledgedBy string     `json:",omitempty"`
+}
+
+type apiStatus struct {
+	Hostname       string
+	Time           time.Time
+	Checks         []apiCheck
+	LogEvents      []apiLogEvent
+	LogEventsMuted bool
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+//authorizedRequest checks the "Authorization: Bearer <Token>" header
+func (monitor *Monitor) authorizedRequest(r *http.Request) bool {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(monitor.HTTP.Token)) == 1
+}
+
+//serveStatus returns every check and log event as a JSON document
+func (monitor *Monitor) serveStatus(w http.ResponseWriter, r *http.Request) {
+	if !monitor.authorizedRequest(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="ftvmon"`)
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return
+	}
+	checks, events := monitor.samples()
+	status := apiStatus{Hostname: monitor.hostname, Time: time.Now(), Checks: []apiCheck{}, LogEvents: []apiLogEvent{}}
+	for _, c := range checks {
+		check := apiCheck{
+			Name:           c.name,
+			Category:       c.category,
+			Enabled:        c.enabled,
+			Updated:        optionalTime(c.updated),
+			Warning:        c.warning,
+			Critical:       c.critical,
+			Severity:       c.severity.String(),
+			Message:        c.message,
+			Status:         c.status,
+			Failing:        c.failing,
+			Failure:        c.failure,
+			AcknowledgedBy: c.ackedBy,
+			Muted:          c.muted,
+		}
+		if !c.updated.IsZero() {
+			value := c.value
+			check.Value = &value
+		}
+		if c.severity != SeverityOK {
+			check.AlertSince = optionalTime(c.since)
+		}
+		status.Checks = append(status.Checks, check)
+	}
+	for _, e := range events {
+		event := apiLogEvent{
+			File:           e.file,
+			Match:          e.match,
+			Enabled:        e.enabled,
+			Threshold:      e.threshold,
+			Window:         e.minutes,
+			Count:          e.window,
+			Matches:        e.matched,
+			Alert:          e.alert,
+			AcknowledgedBy: e.ackedBy,
+		}
+		if e.alert {
+			event.AlertSince = optionalTime(e.since)
+		}
+		status.LogEvents = append(status.LogEvents, event)
+	}
+	status.LogEventsMuted = monitor.muted(logsCheck)
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(status)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+//maxBatchText keeps consolidated messages under the telegram limit of 4096 characters
+const maxBatchText = 4000
+
+const (
+	//batchHeader is the most render adds once per message: "N alerts"
+	batchHeader = 16
+	//itemOverhead is the most render adds to an item besides its host, category and text: separators, the severity
+	//and "Acknowledged by <username> at <time>", which is added when the alert is acknowledged
+	itemOverhead = 100
+	truncated    = "... (truncated)"
+)
+
+//batchItem is an alert waiting for its batch or sent in it
+type batchItem struct {
+	Host     string //agent which sent the alert, "" for this host
+	Category string
+	Severity Severity
+	Text     string
+	AlertID  int //sentAlert which can be acknowledged, 0 if none
+}
+
+//batch is a telegram message consolidating one or more alerts, batches with alerts
+//which can be acknowledged are kept to re-render them on acknowledgement
+type batch struct {
+	Message tb.StoredMessage
+	Items   []batchItem
+}
+
+//pendingBatch holds alerts of a recipient until the batch window is over
+type pendingBatch struct {
+	since time.Time
+	items []batchItem
+	flush bool //a critical alert is waiting, send now
+}
+
+func messageKey(m tb.StoredMessage) string {
+	return fmt.Sprintf("%d/%s", m.ChatID, m.MessageID)
+}
+
+func (b *batch) contains(alertID int) bool {
+	for _, item := range b.Items {
+		if item.AlertID == alertID {
+			return true
+		}
+	}
+	return false
+}
+
+//enqueue adds the alert to the pending batch of the recipient, called by msgDispatcher only
+func (monitor *Monitor) enqueue(recipient string, item batchItem) {
+	p, found := monitor.pending[recipient]
+	if !found {
+		p = &pendingBatch{since: time.Now()}
+		monitor.pending[recipient] = p
+	}
+	p.items = append(p.items, item)
+	if item.Severity == SeverityCritical {
+		p.flush = true
+	}
+}
+
+//flushBatches sends pending batches which window is over or which have a critical alert, all of them if all is true
+func (monitor *Monitor) flushBatches(now time.Time, all bool) {
+	ackMutex.Lock()
+	window := monitor.batchWindow
+	ackMutex.Unlock()
+	for recipient, p := range monitor.pending {
+		if all || p.flush || now.Sub(p.since) >= window {
+			delete(monitor.pending, recipient)
+			monitor.sendBatches(recipient, p.items)
+		}
+	}
+}
+
+//itemSize is the most an item can take in a rendered message
+func (monitor *Monitor) itemSize(item batchItem) int {
+	host := item.Host
+	if host == "" {
+		host = monitor.hostname
+	}
+	return len(host) + len(item.Category) + len(item.Text) + itemOverhead
+}
+
+//fitItem truncates the text of an item which does not fit a message alone
+func (monitor *Monitor) fitItem(item batchItem) batchItem {
+	over := batchHeader + monitor.itemSize(item) - maxBatchText
+	if over <= 0 {
+		return item
+	}
+	cut := len(item.Text) - over - len(truncated)
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(item.Text[cut]) {
+		cut--
+	}
+	item.Text = item.Text[:cut] + truncated
+	return item
+}
+
+//sendBatches posts the items to the recipient, in as many messages as needed to fit the telegram limit
+func (monitor *Monitor) sendBatches(recipient string, items []batchItem) {
+	for i := range items {
+		items[i] = monitor.fitItem(items[i])
+	}
+	for len(items) > 0 {
+		n, size := 0, batchHeader
+		for n < len(items) && (n == 0 || size+monitor.itemSize(items[n]) <= maxBatchText) {
+			size += monitor.itemSize(items[n])
+			n++
+		}
+		monitor.post(recipient, items[:n])
+		items = items[n:]
+	}
+}
+
+//render formats the batch and its Acknowledge buttons, markup is nil if nothing can be acknowledged.
+//ackMutex has to be locked
+func (monitor *Monitor) render(items []batchItem) (text string, markup *tb.ReplyMarkup) {
+	ackedBy := func(item batchItem) string {
+		if sent, found := monitor.sentAlerts[item.AlertID]; found && sent.AckedBy != "" {
+			return fmt.Sprintf("%s at %s", sent.AckedBy, sent.AckedAt.Format(time.RFC3339))
+		}
+		return ""
+	}
+	var buttons [][]tb.InlineButton
+	addButton := func(item batchItem, label string) {
+		if sent, found := monitor.sentAlerts[item.AlertID]; found && sent.AckedBy == "" {
+			button := ackButton
+			button.Text = label
+			button.Data = strconv.Itoa(item.AlertID)
+			buttons = append(buttons, []tb.InlineButton{button})
+		}
+	}
+	host := func(item batchItem) string {
+		if item.Host != "" {
+			return item.Host
+		}
+		return monitor.hostname
+	}
+	if len(items) == 1 {
+		item := items[0]
+		text = host(item) + ": " + Alert{Category: item.Category, Severity: item.Severity, Text: item.Text}.String()
+		if by := ackedBy(item); by != "" {
+			text += "\nAcknowledged by " + by
+		}
+		addButton(item, ackButton.Text)
+	} else {
+		//grouped by host and category, in the order of arrival, the host is named once if it is the same for all
+		sameHost := true
+		for _, item := range items {
+			if host(item) != host(items[0]) {
+				sameHost = false
+			}
+		}
+		type group struct {
+			host     string
+			category string
+		}
+		var groups []group
+		grouped := make(map[group][]batchItem)
+		for _, item := range items {
+			g := group{host(item), item.Category}
+			if _, found := grouped[g]; !found {
+				groups = append(groups, g)
+			}
+			grouped[g] = append(grouped[g], item)
+		}
+		lines := []string{fmt.Sprintf("%d alerts", len(items))}
+		if sameHost {
+			lines[0] = host(items[0]) + ": " + lines[0]
+		}
+		for _, g := range groups {
+			title := g.category
+			if !sameHost {
+				title = strings.TrimSpace(g.host + " " + g.category)
+			}
+			if title != "" {
+				lines = append(lines, title+":")
+			}
+			for i, item := range grouped[g] {
+				line := Alert{Severity: item.Severity, Text: item.Text}.String()
+				if by := ackedBy(item); by != "" {
+					line += " (acknowledged by " + by + ")"
+				}
+				lines = append(lines, line)
+				label := strings.TrimSpace(ackButton.Text + " " + title)
+				if len(grouped[g]) > 1 {
+					label += fmt.Sprintf(" #%d", i+1)
+				}
+				addButton(item, label)
+			}
+		}
+		text = strings.Join(lines, "\n")
+	}
+	if len(buttons) > 0 {
+		markup = &tb.ReplyMarkup{InlineKeyboard: buttons}
+	}
+	return
+}
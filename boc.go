@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"math/bits"
+)
+
+//TVM cells and bags of cells (BoC), as returned by the lite server
+
+const (
+	bocMagic = 0xb5ee9c72
+
+	cellPrunedBranch = 1
+	cellMerkleProof  = 3
+)
+
+type cell struct {
+	data   []byte
+	bits   int
+	refs   []*cell
+	exotic bool
+}
+
+//parseBoC returns the root cells of a serialized bag of cells
+func parseBoC(data []byte) (roots []*cell, err error) {
+	r := bytes.NewReader(data)
+	readUint := func(n int) int {
+		var v int
+		for i := 0; i < n; i++ {
+			b, e := r.ReadByte()
+			if e != nil {
+				err = fmt.Errorf("BoC: unexpected end of data")
+			}
+			v = v<<8 | int(b)
+		}
+		return v
+	}
+	if len(data) < 6 || binary.BigEndian.Uint32(data) != bocMagic {
+		return nil, fmt.Errorf("BoC: unsupported format")
+	}
+	r.Seek(4, 0)
+	flags := readUint(1)
+	hasIndex, size := flags&0x80 != 0, flags&7
+	offBytes := readUint(1)
+	if size == 0 || size > 4 || offBytes == 0 || offBytes > 8 {
+		return nil, fmt.Errorf("BoC: invalid header")
+	}
+	count, rootCount := readUint(size), readUint(size)
+	readUint(size) //absent
+	readUint(offBytes)
+	rootIndexes := make([]int, rootCount)
+	for i := range rootIndexes {
+		rootIndexes[i] = readUint(size)
+	}
+	if hasIndex {
+		r.Seek(int64(count*offBytes), 1)
+	}
+	if err != nil {
+		return
+	}
+	if count > len(data) {
+		return nil, fmt.Errorf("BoC: invalid number of cells %d", count)
+	}
+	cells := make([]*cell, count)
+	refIndexes := make([][]int, count)
+	for i := range cells {
+		d1, d2 := readUint(1), readUint(1)
+		c := &cell{exotic: d1&8 != 0}
+		if d1&16 != 0 {
+			//hashes and depths are stored, they are not needed
+			r.Seek(int64((bits.OnesCount(uint(d1>>5))+1)*(32+2)), 1)
+		}
+		c.data = make([]byte, (d2+1)/2)
+		if n, _ := r.Read(c.data); n != len(c.data) {
+			return nil, fmt.Errorf("BoC: unexpected end of data")
+		}
+		c.bits = len(c.data) * 8
+		if d2%2 != 0 && len(c.data) > 0 {
+			//the last byte is completed with 1 and zeros
+			last := c.data[len(c.data)-1]
+			if last == 0 {
+				return nil, fmt.Errorf("BoC: invalid cell data")
+			}
+			c.bits -= bits.TrailingZeros8(last) + 1
+			c.data = c.data[:(c.bits+7)/8]
+			if c.bits%8 != 0 {
+				c.data[len(c.data)-1] &^= 0xff >> uint(c.bits%8)
+			}
+		}
+		for j := 0; j < d1&7; j++ {
+			ref := readUint(size)
+			if ref <= i || ref >= count {
+				return nil, fmt.Errorf("BoC: invalid reference")
+			}
+			refIndexes[i] = append(refIndexes[i], ref)
+		}
+		if err != nil {
+			return
+		}
+		cells[i] = c
+	}
+	for i := count - 1; i >= 0; i-- {
+		for _, ref := range refIndexes[i] {
+			cells[i].refs = append(cells[i].refs, cells[ref])
+		}
+	}
+	for _, i := range rootIndexes {
+		if i >= count {
+			return nil, fmt.Errorf("BoC: invalid root")
+		}
+		roots = append(roots, cells[i])
+	}
+	return
+}
+
+//serializeBoC serializes a tree of ordinary cells with a single root
+func serializeBoC(root *cell) []byte {
+	var cells []*cell
+	var collect func(c *cell)
+	collect = func(c *cell) {
+		cells = append(cells, c)
+		for _, ref := range c.refs {
+			collect(ref)
+		}
+	}
+	collect(root)
+	index := make(map[*cell]int)
+	for i, c := range cells {
+		index[c] = i
+	}
+	bytesFor := func(n int) int {
+		return (bits.Len(uint(n)) + 7) / 8
+	}
+	size := bytesFor(len(cells))
+	if size == 0 {
+		size = 1
+	}
+	var body bytes.Buffer
+	writeUint := func(b *bytes.Buffer, v int, n int) {
+		for i := n - 1; i >= 0; i-- {
+			b.WriteByte(byte(v >> (8 * i)))
+		}
+	}
+	for _, c := range cells {
+		data := make([]byte, (c.bits+7)/8)
+		copy(data, c.data)
+		if c.bits%8 != 0 {
+			data[len(data)-1] |= 0x80 >> (c.bits % 8)
+		}
+		body.WriteByte(byte(len(c.refs)))
+		body.WriteByte(byte(c.bits/8 + (c.bits+7)/8))
+		body.Write(data)
+		for _, ref := range c.refs {
+			writeUint(&body, index[ref], size)
+		}
+	}
+	offBytes := bytesFor(body.Len())
+	if offBytes == 0 {
+		offBytes = 1
+	}
+	var boc bytes.Buffer
+	binary.Write(&boc, binary.BigEndian, uint32(bocMagic))
+	boc.WriteByte(byte(size))
+	boc.WriteByte(byte(offBytes))
+	writeUint(&boc, len(cells), size)
+	writeUint(&boc, 1, size)
+	writeUint(&boc, 0, size)
+	writeUint(&boc, body.Len(), offBytes)
+	writeUint(&boc, 0, size)
+	boc.Write(body.Bytes())
+	return boc.Bytes()
+}
+
+//cellSlice reads a cell, the first error is kept in err and zero values are returned after it
+type cellSlice struct {
+	c   *cell
+	pos int
+	ref int
+	err error
+}
+
+//slice starts reading a cell, the content of Merkle proofs is read instead of the proof
+func (c *cell) slice() *cellSlice {
+	for c.exotic && c.bits >= 8 && c.data[0] == cellMerkleProof && len(c.refs) == 1 {
+		c = c.refs[0]
+	}
+	s := &cellSlice{c: c}
+	if c.exotic {
+		if c.bits >= 8 && c.data[0] == cellPrunedBranch {
+			s.err = fmt.Errorf("Cell: the data is pruned from the proof")
+		} else {
+			s.err = fmt.Errorf("Cell: unsupported exotic cell")
+		}
+	}
+	return s
+}
+
+func (s *cellSlice) check(n int) bool {
+	if s.err == nil && s.pos+n > s.c.bits {
+		s.err = fmt.Errorf("Cell: not enough data")
+	}
+	return s.err == nil
+}
+
+func (s *cellSlice) bit() bool {
+	if !s.check(1) {
+		return false
+	}
+	b := s.c.data[s.pos/8]&(0x80>>(s.pos%8)) != 0
+	s.pos++
+	return b
+}
+
+//uint reads an unsigned integer of up to 64 bits
+func (s *cellSlice) uint(n int) (v uint64) {
+	if !s.check(n) {
+		return
+	}
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if s.bit() {
+			v |= 1
+		}
+	}
+	return
+}
+
+//bigInt reads a signed integer of n bits
+func (s *cellSlice) bigInt(n int) *big.Int {
+	v := new(big.Int)
+	if !s.check(n) {
+		return v
+	}
+	negative := s.bit()
+	for i := 1; i < n; i++ {
+		v.Lsh(v, 1)
+		if s.bit() {
+			v.SetBit(v, 0, 1)
+		}
+	}
+	if negative {
+		v.Sub(v, new(big.Int).Lsh(big.NewInt(1), uint(n-1)))
+	}
+	return v
+}
+
+//bytes reads n bytes
+func (s *cellSlice) bytes(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(s.uint(8))
+	}
+	return b
+}
+
+//varUint reads VarUInteger n: the length in bytes, then the value
+func (s *cellSlice) varUint(n int) *big.Int {
+	length := int(s.uint(bits.Len(uint(n - 1))))
+	return new(big.Int).SetBytes(s.bytes(length))
+}
+
+func (s *cellSlice) loadRef() *cellSlice {
+	if s.err == nil && s.ref >= len(s.c.refs) {
+		s.err = fmt.Errorf("Cell: not enough references")
+	}
+	if s.err != nil {
+		return &cellSlice{c: &cell{}, err: s.err}
+	}
+	s.ref++
+	return s.c.refs[s.ref-1].slice()
+}
+
+//dictLabel reads a label of a hashmap edge with up to m bits left in the key
+func (s *cellSlice) dictLabel(m int) (label uint64, n int) {
+	lenBits := bits.Len(uint(m))
+	switch {
+	case !s.bit():
+		//hml_short$0 len:(Unary ~n) s:(n * Bit)
+		for s.bit() {
+			n++
+		}
+		label = s.uint(n)
+	case !s.bit():
+		//hml_long$10 n:(#<= m) s:(n * Bit)
+		n = int(s.uint(lenBits))
+		label = s.uint(n)
+	default:
+		//hml_same$11 v:Bit n:(#<= m)
+		same := s.bit()
+		n = int(s.uint(lenBits))
+		if same {
+			label = 1<<uint(n) - 1
+		}
+	}
+	if s.err == nil && n > m {
+		s.err = fmt.Errorf("Cell: invalid hashmap label")
+	}
+	return
+}
+
+//dictGet returns the value of a key of n bits in a Hashmap n starting at s, nil if the key is not found
+func dictGet(s *cellSlice, n int, key uint64) (*cellSlice, error) {
+	for {
+		label, l := s.dictLabel(n)
+		if s.err != nil {
+			return nil, s.err
+		}
+		if label != (key>>uint(n-l))&(1<<uint(l)-1) {
+			return nil, nil
+		}
+		n -= l
+		if n == 0 {
+			return s, nil
+		}
+		left := s.loadRef()
+		right := s.loadRef()
+		s = left
+		if key>>uint(n-1)&1 != 0 {
+			s = right
+		}
+		n--
+	}
+}
+
+//dictEach calls f with every key and value of a Hashmap n starting at s
+func dictEach(s *cellSlice, n int, f func(key uint64, value *cellSlice) error) error {
+	var walk func(s *cellSlice, n int, prefix uint64) error
+	walk = func(s *cellSlice, n int, prefix uint64) error {
+		label, l := s.dictLabel(n)
+		if s.err != nil {
+			return s.err
+		}
+		prefix = prefix<<uint(l) | label
+		n -= l
+		if n == 0 {
+			return f(prefix, s)
+		}
+		left, right := s.loadRef(), s.loadRef()
+		if err := walk(left, n-1, prefix<<1); err != nil {
+			return err
+		}
+		return walk(right, n-1, prefix<<1|1)
+	}
+	return walk(s, n, 0)
+}
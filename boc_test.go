@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+//bitCell makes a cell of a string of bits, spaces are skipped
+func bitCell(bits string, refs ...*cell) *cell {
+	bits = strings.Replace(bits, " ", "", -1)
+	c := &cell{data: make([]byte, (len(bits)+7)/8), bits: len(bits), refs: refs}
+	for i, b := range bits {
+		if b == '1' {
+			c.data[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return c
+}
+
+func TestBoCRoundTrip(t *testing.T) {
+	leaf := bitCell("1010 1")
+	root := bitCell("1111 0000 1100 1", bitCell("", leaf), bitCell("0000 0001 0000 0010 0000 0011"))
+	roots, err := parseBoC(serializeBoC(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 {
+		t.Fatalf("%d roots", len(roots))
+	}
+	var compare func(a, b *cell, path string)
+	compare = func(a, b *cell, path string) {
+		if a.bits != b.bits || !bytes.Equal(a.data, b.data) || len(a.refs) != len(b.refs) {
+			t.Errorf("cell %s: %d bits %x, want %d bits %x", path, b.bits, b.data, a.bits, a.data)
+			return
+		}
+		for i := range a.refs {
+			compare(a.refs[i], b.refs[i], fmt.Sprintf("%s/%d", path, i))
+		}
+	}
+	compare(root, roots[0], "root")
+}
+
+func TestParseBoCErrors(t *testing.T) {
+	boc := serializeBoC(bitCell("1010", bitCell("11")))
+	tests := map[string][]byte{
+		"magic":     append([]byte{0, 0, 0, 0}, boc[4:]...),
+		"truncated": boc[:len(boc)-2],
+		"header":    boc[:5],
+	}
+	//the root refers to itself
+	badRef := append([]byte{}, boc...)
+	badRef[len(badRef)-4] = 0
+	tests["reference"] = badRef
+	//the last byte of the root has no completion tag
+	noTag := append([]byte{}, boc...)
+	noTag[len(noTag)-5] = 0
+	tests["completion tag"] = noTag
+	for name, data := range tests {
+		if _, err := parseBoC(data); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestCellSlice(t *testing.T) {
+	s := bitCell("1111 1011  0010 0000 0001 0000 0000  101").slice()
+	if v := s.bigInt(8); v.Int64() != -5 {
+		t.Errorf("bigInt = %s, want -5", v)
+	}
+	if v := s.varUint(16); v.Int64() != 256 {
+		t.Errorf("varUint = %s, want 256", v)
+	}
+	if v := s.uint(3); v != 5 || s.err != nil {
+		t.Errorf("uint = %d, %v", v, s.err)
+	}
+	if s.bit(); s.err == nil {
+		t.Errorf("no error reading past the end")
+	}
+	if s.loadRef().err == nil {
+		t.Errorf("no error loading a missing reference")
+	}
+}
+
+func TestDictLabel(t *testing.T) {
+	tests := []struct {
+		bits  string
+		m     int
+		label uint64
+		n     int
+		ok    bool
+	}{
+		{"0 0", 8, 0, 0, true},                //hml_short, empty
+		{"0 110 10", 8, 2, 2, true},           //hml_short
+		{"10 0011 101", 8, 5, 3, true},        //hml_long
+		{"11 1 0100", 8, 15, 4, true},         //hml_same of ones
+		{"11 0 0011", 8, 0, 3, true},          //hml_same of zeros
+		{"10 1 1", 1, 1, 1, true},             //hml_long, 1 bit length
+		{"10 1001 000000000", 8, 0, 9, false}, //longer than the key
+		{"0 1110", 8, 0, 0, false},            //truncated
+	}
+	for _, test := range tests {
+		s := bitCell(test.bits).slice()
+		label, n := s.dictLabel(test.m)
+		if (s.err == nil) != test.ok {
+			t.Errorf("%q: error = %v", test.bits, s.err)
+			continue
+		}
+		if test.ok && (label != test.label || n != test.n) {
+			t.Errorf("%q: label %b of %d bits, want %b of %d", test.bits, label, n, test.label, test.n)
+		}
+	}
+}
+
+//testDict is a Hashmap 4 with 0001 -> 0xaa and 0011 -> 0xf0: the common label 00, a fork, the labels 1 and the values
+func testDict() *cell {
+	return bitCell("0 110 00", bitCell("0 10 1  1010 1010"), bitCell("0 10 1  1111 0000"))
+}
+
+func TestDictGet(t *testing.T) {
+	tests := []struct {
+		key   uint64
+		value int64 //-1 - not found
+	}{
+		{1, 0xaa},
+		{3, 0xf0},
+		{0, -1},
+		{2, -1},
+		{5, -1},
+		{15, -1},
+	}
+	for _, test := range tests {
+		value, err := dictGet(testDict().slice(), 4, test.key)
+		if err != nil {
+			t.Errorf("key %d: %s", test.key, err)
+			continue
+		}
+		switch {
+		case value == nil && test.value != -1:
+			t.Errorf("key %d is not found", test.key)
+		case value != nil && test.value == -1:
+			t.Errorf("key %d is found", test.key)
+		case value != nil && int64(value.uint(8)) != test.value:
+			t.Errorf("key %d: wrong value", test.key)
+		}
+	}
+	if _, err := dictGet(bitCell("0 110 00").slice(), 4, 1); err == nil {
+		t.Errorf("no error for a fork without references")
+	}
+}
+
+func TestDictEach(t *testing.T) {
+	var keys, values []uint64
+	err := dictEach(testDict().slice(), 4, func(key uint64, value *cellSlice) error {
+		keys = append(keys, key)
+		values = append(values, value.uint(8))
+		return value.err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys, values) != "[1 3] [170 240]" {
+		t.Errorf("keys and values = %v %v", keys, values)
+	}
+	stop := fmt.Errorf("stop")
+	if err := dictEach(testDict().slice(), 4, func(uint64, *cellSlice) error { return stop }); err != stop {
+		t.Errorf("error = %v, want the error of f", err)
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	r := liteTestAnswer(t, "getConfigParams", tlConfigInfo)
+	r.uint32()
+	readBlockID(r)
+	r.bytes()
+	proof := r.bytes()
+	roots, err := parseBoC(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !roots[0].exotic {
+		t.Fatalf("the root is not a Merkle proof")
+	}
+	//the proof is read as the shard state, the branches which are not needed are pruned
+	state := roots[0].slice()
+	if tag := state.uint(32); tag != 0x9023afe2 {
+		t.Errorf("tag = %08x", tag)
+	}
+	pruned := state.loadRef()
+	if pruned.uint(1); pruned.err == nil || !strings.Contains(pruned.err.Error(), "pruned") {
+		t.Errorf("error = %v, want pruned", pruned.err)
+	}
+}
+
+func TestStackValue(t *testing.T) {
+	tinyint := func(v int64) *cell {
+		return bitCell(fmt.Sprintf("00000001 %064b", uint64(v)))
+	}
+	big257 := new(big.Int).Lsh(big.NewInt(1), 200)
+	tests := []struct {
+		name string
+		c    *cell
+		want string //"" - an error is expected
+	}{
+		{"null", bitCell("00000000"), "<nil>"},
+		{"tinyint", tinyint(-7), "-7"},
+		{"int", bitCell("00000010 0000000 0" + fmt.Sprintf("%0256b", big257)), big257.String()},
+		{"negative int", bitCell("00000010 0000000 1" + strings.Repeat("1", 255) + "0"), "-2"},
+		{"nan", bitCell("00000010 11111111"), ""},
+		{"empty tuple", bitCell("00000111 0000000000000000"), "[]"},
+		{"tuple", bitCell("00000111 0000000000000010", tinyint(1), tinyint(2)), "[1 2]"},
+		{"tuple of 3", bitCell("00000111 0000000000000011", bitCell("", tinyint(1), tinyint(2)), tinyint(3)), "[1 2 3]"},
+		{"truncated tuple", bitCell("00000111 0000000000000010", tinyint(1)), ""},
+		{"unsupported", bitCell("00000110"), ""},
+	}
+	for _, test := range tests {
+		value, err := stackValue(test.c.slice())
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if got := stackString(value); got != test.want {
+			t.Errorf("%s: %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestStackList(t *testing.T) {
+	//vm_stk_cons#_ rest:^(VmStackList n) tos:VmStackValue, the bottom is the deepest
+	bottom := bitCell(fmt.Sprintf("00000001 %064b", 1), bitCell(""))
+	top := bitCell(fmt.Sprintf("00000001 %064b", 2), bottom)
+	stack, err := stackList(top.slice(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stackString(stack); got != "[1 2]" {
+		t.Errorf("stack = %s, want [1 2]", got)
+	}
+}
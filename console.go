@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+)
+
+//Validator engine control interface queries (ton_api.tl), as sent by validator-engine-console
+
+const (
+	tlControlQuery      = 0xa476bdc0 //engine.validator.controlQuery data:bytes = Object
+	tlControlQueryError = 0x77269a1f //engine.validator.controlQueryError code:int message:string = engine.validator.ControlQueryError
+	tlGetStats          = 0x52d5c311 //engine.validator.getStats = engine.validator.Stats
+	tlStats             = 0x5d49d36f //engine.validator.stats stats:(vector engine.validator.oneStat) = engine.validator.Stats
+
+	consoleAddr = "127.0.0.1:3030" //default Node ConsoleAddr
+)
+
+//validatorStats is the result of getstats
+type validatorStats struct {
+	UnixTime             int64 //the node's time
+	MasterchainBlockTime int64 //time of the last masterchain block known to the node
+	MasterchainBlock     string
+	Values               map[string]string //all the stats by name
+}
+
+//timeDiff is TIME_DIFF of the node: how far the last masterchain block is behind, seconds (negative)
+func (stats *validatorStats) timeDiff() int64 {
+	return stats.MasterchainBlockTime - stats.UnixTime
+}
+
+//consoleClient is an authenticated connection to the validator engine control interface
+type consoleClient struct {
+	*adnlConn
+}
+
+//dialConsole connects to the control interface with the Node ClientKey and ServerKey
+func (n *cppNode) dialConsole(ctx context.Context) (*consoleClient, error) {
+	serverKey, err := readPublicKey(n.keyFile(n.config.ServerKey))
+	if err != nil {
+		return nil, err
+	}
+	clientKey, err := readPrivateKey(n.keyFile(n.config.ClientKey))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialADNL(ctx, n.config.ConsoleAddr, serverKey)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.authenticate(clientKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &consoleClient{conn}, nil
+}
+
+//query sends a control query and returns a reader of the answer, checking its constructor
+func (c *consoleClient) query(q []byte, answer uint32) (*tlReader, error) {
+	var w tlWriter
+	w.uint32(tlControlQuery)
+	w.bytes(q)
+	data, err := c.adnlConn.query(w.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return consoleAnswer(data, answer)
+}
+
+//consoleAnswer returns a reader of a control query answer, checking its constructor
+func consoleAnswer(data []byte, answer uint32) (*tlReader, error) {
+	r := &tlReader{data: data}
+	switch id := r.uint32(); {
+	case r.err != nil:
+		return nil, r.err
+	case id == tlControlQueryError:
+		code := r.int32()
+		return nil, fmt.Errorf("Control query error %d: %s", code, r.bytes())
+	case id != answer:
+		return nil, fmt.Errorf("Unexpected control query answer %08x", id)
+	}
+	return r, nil
+}
+
+//stats returns the result of getstats
+func (c *consoleClient) stats() (stats validatorStats, err error) {
+	var w tlWriter
+	w.uint32(tlGetStats)
+	r, err := c.query(w.Bytes(), tlStats)
+	if err != nil {
+		return
+	}
+	return parseStats(r)
+}
+
+//parseStats reads engine.validator.stats
+func parseStats(r *tlReader) (stats validatorStats, err error) {
+	count := r.uint32()
+	if r.err == nil && int(count) > len(r.data) {
+		return stats, fmt.Errorf("Invalid getstats answer")
+	}
+	stats.Values = make(map[string]string)
+	//engine.validator.oneStat is bare in the vector, without the constructor
+	for i := uint32(0); i < count && r.err == nil; i++ {
+		key := string(r.bytes())
+		stats.Values[key] = string(r.bytes())
+	}
+	if r.err != nil {
+		return stats, r.err
+	}
+	stats.MasterchainBlock = stats.Values["masterchainblock"]
+	for key, v := range map[string]*int64{"unixtime": &stats.UnixTime, "masterchainblocktime": &stats.MasterchainBlockTime} {
+		value, found := stats.Values[key]
+		if !found {
+			return stats, fmt.Errorf("No %s in getstats", key)
+		}
+		*v, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return stats, fmt.Errorf("Invalid %s in getstats: %q", key, value)
+		}
+	}
+	return
+}
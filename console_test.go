@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+//testdata/getStats.hex was captured from a test control server (built with tonutils-go) answering getstats
+
+func TestParseStats(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/getStats.hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := consoleAnswer(raw, tlStats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := parseStats(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.UnixTime != 1600000100 || stats.MasterchainBlockTime != 1600000090 || stats.timeDiff() != -10 {
+		t.Errorf("stats = %+v", stats)
+	}
+	if stats.MasterchainBlock != "(-1,8000000000000000,123):AA:BB" || len(stats.Values) != 4 || stats.Values["stateserializermasterchainseqno"] != "100" {
+		t.Errorf("values = %v", stats.Values)
+	}
+	r, _ = consoleAnswer(raw[:len(raw)-3], tlStats)
+	if _, err := parseStats(r); err == nil {
+		t.Errorf("no error for a truncated answer")
+	}
+}
+
+func TestParseStatsErrors(t *testing.T) {
+	tests := []struct {
+		stats map[string]string
+		want  string
+	}{
+		{map[string]string{"masterchainblocktime": "1600000090"}, "No unixtime in getstats"},
+		{map[string]string{"unixtime": "1600000100"}, "No masterchainblocktime in getstats"},
+		{map[string]string{"unixtime": "now", "masterchainblocktime": "1600000090"}, `Invalid unixtime in getstats: "now"`},
+	}
+	for _, test := range tests {
+		var w tlWriter
+		w.uint32(uint32(len(test.stats)))
+		for key, value := range test.stats {
+			w.bytes([]byte(key))
+			w.bytes([]byte(value))
+		}
+		_, err := parseStats(&tlReader{data: w.Bytes()})
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%v: error = %v, want %s", test.stats, err, test.want)
+		}
+	}
+	//a count larger than the answer
+	if _, err := parseStats(&tlReader{data: []byte{0xff, 0xff, 0, 0}}); err == nil {
+		t.Errorf("no error for an invalid count")
+	}
+}
+
+func TestConsoleAnswerError(t *testing.T) {
+	raw, _ := hex.DecodeString("1f9a2677ffffffff0d756e6b6e6f776e2071756572790000")
+	_, err := consoleAnswer(raw, tlStats)
+	if err == nil || err.Error() != "Control query error -1: unknown query" {
+		t.Errorf("error = %v", err)
+	}
+	_, err = consoleAnswer([]byte{0x6f, 0xd3, 0x49, 0x5e}, tlStats)
+	if err == nil || !strings.HasPrefix(err.Error(), "Unexpected control query answer 5e49d36f") {
+		t.Errorf("error = %v", err)
+	}
+	if _, err = consoleAnswer([]byte{1}, tlStats); err == nil {
+		t.Errorf("no error for a truncated answer")
+	}
+}
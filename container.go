@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/shirou/gopsutil/mem"
+)
+
+const (
+	cgroupRoot   = "/sys/fs/cgroup"
+	dockerSocket = "/var/run/docker.sock"
+)
+
+func init() {
+	registerCheck("ContainerCPU", "CONTAINER", func(base *baseCheck) Check { return &containerCPUCheck{baseCheck: base} })
+	registerCheck("ContainerThrottling", "CONTAINER", func(base *baseCheck) Check { return &containerThrottlingCheck{baseCheck: base} })
+	registerCheck("ContainerMem", "CONTAINER", func(base *baseCheck) Check { return &containerMemCheck{base} })
+	registerCheck("ContainerOOM", "CONTAINER", func(base *baseCheck) Check { return &containerOOMCheck{baseCheck: base} })
+	registerCheck("ContainerIO", "CONTAINER", func(base *baseCheck) Check { return &containerIOCheck{baseCheck: base} })
+	registerCheck("ContainerState", "CONTAINER", func(base *baseCheck) Check { return &containerStateCheck{baseCheck: base} })
+}
+
+//cgroup locates the accounting files of a container: a cgroup v2 directory or cgroup v1 paths per controller
+type cgroup struct {
+	dir string            //v2
+	v1  map[string]string //v1: controller -> path relative to its hierarchy
+}
+
+func (g *cgroup) file(controller string, name string) string {
+	if g.v1 == nil {
+		return filepath.Join(g.dir, name)
+	}
+	return filepath.Join(cgroupRoot, controller, g.v1[controller], name)
+}
+
+func cgroupV2() bool {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+//cgroupOfPath returns the cgroup of a path, absolute or relative to the hierarchy
+func cgroupOfPath(path string) *cgroup {
+	if cgroupV2() {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(cgroupRoot, path)
+		}
+		return &cgroup{dir: path}
+	}
+	g := &cgroup{v1: make(map[string]string)}
+	for _, controller := range []string{"cpu", "cpuacct", "memory", "blkio"} {
+		g.v1[controller] = path
+	}
+	return g
+}
+
+//cgroupOfPid reads the cgroup of a process from /proc/<pid>/cgroup
+func cgroupOfPid(pid int) (g *cgroup, err error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	g = &cgroup{}
+	v2 := cgroupV2()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		//"hierarchy-ID:controller,controller:path", "0::path" for v2
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if v2 {
+			if fields[0] == "0" {
+				g.dir = filepath.Join(cgroupRoot, fields[2])
+			}
+			continue
+		}
+		if g.v1 == nil {
+			g.v1 = make(map[string]string)
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			g.v1[controller] = fields[2]
+		}
+	}
+	if g.dir == "" && g.v1 == nil {
+		err = fmt.Errorf("No cgroup of process %d", pid)
+	}
+	return
+}
+
+//readKeyed reads "key value" lines, e.g. cpu.stat or memory.stat
+func readKeyed(file string) (values map[string]uint64, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	values = make(map[string]uint64)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			if v, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+				values[fields[0]] = v
+			}
+		}
+	}
+	return
+}
+
+//readUint reads a file with a single number, ok is false for "max" (no limit)
+func readUint(file string) (value uint64, ok bool, err error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return
+	}
+	s := strings.TrimSpace(string(data))
+	if s == "max" {
+		return
+	}
+	value, err = strconv.ParseUint(s, 10, 64)
+	ok = err == nil
+	return
+}
+
+//cgroupCPU is CPU accounting of a cgroup
+type cgroupCPU struct {
+	usage     time.Duration //total CPU time used
+	periods   uint64        //CFS periods with the limit enforced
+	throttled uint64        //periods the cgroup was throttled in
+	limit     float64       //CPUs, 0 if not limited
+}
+
+func (g *cgroup) cpu() (stat cgroupCPU, err error) {
+	if g.v1 == nil {
+		values, err := readKeyed(g.file("cpu", "cpu.stat"))
+		if err != nil {
+			return stat, err
+		}
+		stat.usage = time.Duration(values["usage_usec"]) * time.Microsecond
+		stat.periods, stat.throttled = values["nr_periods"], values["nr_throttled"]
+		//"max 100000" or "200000 100000"
+		data, err := ioutil.ReadFile(g.file("cpu", "cpu.max"))
+		if err == nil {
+			fields := strings.Fields(string(data))
+			if len(fields) == 2 && fields[0] != "max" {
+				quota, _ := strconv.ParseFloat(fields[0], 64)
+				period, _ := strconv.ParseFloat(fields[1], 64)
+				if period > 0 {
+					stat.limit = quota / period
+				}
+			}
+		}
+		return stat, nil
+	}
+	usage, _, err := readUint(g.file("cpuacct", "cpuacct.usage"))
+	if err != nil {
+		return
+	}
+	stat.usage = time.Duration(usage)
+	values, err := readKeyed(g.file("cpu", "cpu.stat"))
+	if err != nil {
+		return
+	}
+	stat.periods, stat.throttled = values["nr_periods"], values["nr_throttled"]
+	//cfs_quota_us is -1 if not limited
+	quota, err := ioutil.ReadFile(g.file("cpu", "cpu.cfs_quota_us"))
+	if err == nil {
+		q, _ := strconv.ParseFloat(strings.TrimSpace(string(quota)), 64)
+		period, _, _ := readUint(g.file("cpu", "cpu.cfs_period_us"))
+		if q > 0 && period > 0 {
+			stat.limit = q / float64(period)
+		}
+	}
+	return stat, nil
+}
+
+//memory returns the working set (usage without inactive file cache) and the limit, 0 if not limited
+func (g *cgroup) memory() (usage uint64, limit uint64, err error) {
+	usageFile, limitFile, inactive := "memory.current", "memory.max", "inactive_file"
+	if g.v1 != nil {
+		usageFile, limitFile, inactive = "memory.usage_in_bytes", "memory.limit_in_bytes", "total_inactive_file"
+	}
+	usage, _, err = readUint(g.file("memory", usageFile))
+	if err != nil {
+		return
+	}
+	if stat, err := readKeyed(g.file("memory", "memory.stat")); err == nil && stat[inactive] < usage {
+		usage -= stat[inactive]
+	}
+	limit, ok, err := readUint(g.file("memory", limitFile))
+	if err != nil {
+		return
+	}
+	//v1 reports a huge number if not limited
+	if !ok || limit >= 1<<60 {
+		limit = 0
+	}
+	return
+}
+
+//oomKills returns the number of processes killed by the OOM killer in the cgroup
+func (g *cgroup) oomKills() (kills uint64, err error) {
+	file := g.file("memory", "memory.events")
+	if g.v1 != nil {
+		file = g.file("memory", "memory.oom_control")
+	}
+	values, err := readKeyed(file)
+	if err != nil {
+		return
+	}
+	kills, found := values["oom_kill"]
+	if !found {
+		err = fmt.Errorf("oom_kill is not reported by %s, the kernel is too old", file)
+	}
+	return
+}
+
+//io returns bytes read and written by the cgroup
+func (g *cgroup) io() (read uint64, written uint64, err error) {
+	if g.v1 == nil {
+		//"8:0 rbytes=1024 wbytes=2048 rios=1 wios=2 dbytes=0 dios=0"
+		data, err := ioutil.ReadFile(g.file("io", "io.stat"))
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, field := range strings.Fields(string(data)) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			v, _ := strconv.ParseUint(kv[1], 10, 64)
+			switch kv[0] {
+			case "rbytes":
+				read += v
+			case "wbytes":
+				written += v
+			}
+		}
+		return read, written, nil
+	}
+	//"8:0 Read 1024"
+	data, err := ioutil.ReadFile(g.file("blkio", "blkio.throttle.io_service_bytes"))
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		v, _ := strconv.ParseUint(fields[2], 10, 64)
+		switch fields[1] {
+		case "Read":
+			read += v
+		case "Write":
+			written += v
+		}
+	}
+	return
+}
+
+//dockerContainer is the part of the Docker Engine API container inspect response ftvmon needs
+type dockerContainer struct {
+	ID    string `json:"Id"`
+	Name  string
+	State struct {
+		Status    string
+		Running   bool
+		OOMKilled bool
+		Pid       int
+		StartedAt time.Time
+	}
+	RestartCount int
+}
+
+//inspectContainer gets the container from the Docker Engine API over its unix socket
+func inspectContainer(ctx context.Context, name string) (container dockerContainer, err error) {
+	client := http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", dockerSocket)
+			},
+		},
+	}
+	req, err := http.NewRequest("GET", "http://docker/containers/"+url.PathEscape(name)+"/json", nil)
+	if err != nil {
+		return
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		err = fmt.Errorf("Docker: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&container)
+	return
+}
+
+//containerCgroup returns the cgroup of the container Name (via Docker) or of the cgroup Path
+func (c *baseCheck) containerCgroup(ctx context.Context) (g *cgroup, err error) {
+	if c.metric.Path != "" {
+		return cgroupOfPath(c.metric.Path), nil
+	}
+	if c.metric.Name == "" {
+		return nil, fmt.Errorf("Set the container Name or the cgroup Path of %s", c.name)
+	}
+	container, err := inspectContainer(ctx, c.metric.Name)
+	if err != nil {
+		return
+	}
+	if !container.State.Running {
+		return nil, fmt.Errorf("Container %s is %s", c.metric.Name, container.State.Status)
+	}
+	return cgroupOfPid(container.State.Pid)
+}
+
+//container names the container or the cgroup in messages
+func (c *baseCheck) container() string {
+	if c.metric.Name != "" {
+		return c.metric.Name
+	}
+	return c.metric.Path
+}
+
+//containerError logs the error and returns the short one reported to subscribers
+func (c *baseCheck) containerError(err error, what string) error {
+	logChecks.With("check", c.name).Errorf("%s", err)
+	return fmt.Errorf("CONTAINER: Can't get %s of %s", what, c.container())
+}
+
+//severityOfEvents is severityAbove for counts of events, any event is critical if no threshold is set
+func (c *baseCheck) severityOfEvents(count float64) (Severity, float64) {
+	if c.metric.lowest() <= 0 {
+		if count > 0 {
+			return SeverityCritical, 1
+		}
+		return SeverityOK, 1
+	}
+	return c.metric.severityAbove(count)
+}
+
+//cgroupRate keeps the previous sample of counters for rate-based container checks
+type cgroupRate struct {
+	last   []uint64
+	lastTS time.Time
+}
+
+//delta returns increases of the counters since the previous call and seconds elapsed, errFirstSample on the first call.
+//Counters going back (the container was restarted) are taken as a first sample
+func (r *cgroupRate) delta(counters ...uint64) (deltas []uint64, seconds float64, err error) {
+	now := time.Now()
+	last, lastTS := r.last, r.lastTS
+	r.last, r.lastTS = counters, now
+	if len(last) != len(counters) {
+		return nil, 0, errFirstSample
+	}
+	for i := range counters {
+		if counters[i] < last[i] {
+			return nil, 0, errFirstSample
+		}
+		deltas = append(deltas, counters[i]-last[i])
+	}
+	seconds = now.Sub(lastTS).Seconds()
+	return
+}
+
+type containerCPUCheck struct {
+	*baseCheck
+	cgroupRate
+}
+
+func (c *containerCPUCheck) Run(ctx context.Context) (result Result, err error) {
+	g, err := c.containerCgroup(ctx)
+	if err != nil {
+		err = c.containerError(err, "CPU usage")
+		return
+	}
+	stat, err := g.cpu()
+	if err != nil {
+		err = c.containerError(err, "CPU usage")
+		return
+	}
+	deltas, seconds, err := c.delta(uint64(stat.usage))
+	if err != nil {
+		return
+	}
+	cpus := stat.limit
+	if cpus == 0 {
+		cpus = float64(runtime.NumCPU())
+	}
+	used := time.Duration(deltas[0]).Seconds() / seconds
+	result.Value = used / cpus * 100
+	severity, threshold := c.metric.severityAbove(result.Value)
+	result.Severity = severity
+	if severity != SeverityOK {
+		result.Message = fmt.Sprintf("CPU usage of %s %.2f%% of its limit is too high, over %.2f%% threshold", c.container(), result.Value, threshold)
+	} else {
+		result.Message = fmt.Sprintf("CPU usage of %s %.2f%% of its limit is back to normal, less than %.2f%% threshold", c.container(), result.Value, threshold)
+	}
+	limit := "not limited"
+	if stat.limit > 0 {
+		limit = fmt.Sprintf("limit %.2f CPUs", stat.limit)
+	}
+	result.MsgStatus = fmt.Sprintf("CONTAINER: %s uses %.2f CPUs (%.2f%%), %s", c.container(), used, result.Value, limit)
+	return
+}
+
+type containerThrottlingCheck struct {
+	*baseCheck
+	cgroupRate
+}
+
+func (c *containerThrottlingCheck) Run(ctx context.Context) (result Result, err error) {
+	g, err := c.containerCgroup(ctx)
+	if err != nil {
+		err = c.containerError(err, "CPU throttling")
+		return
+	}
+	stat, err := g.cpu()
+	if err != nil {
+		err = c.containerError(err, "CPU throttling")
+		return
+	}
+	deltas, _, err := c.delta(stat.periods, stat.throttled)
+	if err != nil {
+		return
+	}
+	if deltas[0] > 0 {
+		result.Value = float64(deltas[1]) / float64(deltas[0]) * 100
+	}
+	severity, threshold := c.metric.severityAbove(result.Value)
+	result.Severity = severity
+	if severity != SeverityOK {
+		result.Message = fmt.Sprintf("%s is throttled in %.2f%% of CPU periods, over %.2f%% threshold", c.container(), result.Value, threshold)
+	} else {
+		result.Message = fmt.Sprintf("CPU throttling of %s %.2f%% is back to normal, less than %.2f%% threshold", c.container(), result.Value, threshold)
+	}
+	result.MsgStatus = fmt.Sprintf("CONTAINER: %s is throttled in %.2f%% of CPU periods (%d of %d)", c.container(), result.Value, deltas[1], deltas[0])
+	return
+}
+
+type containerMemCheck struct{ *baseCheck }
+
+func (c *containerMemCheck) Run(ctx context.Context) (result Result, err error) {
+	g, err := c.containerCgroup(ctx)
+	if err != nil {
+		err = c.containerError(err, "memory usage")
+		return
+	}
+	usage, limit, err := g.memory()
+	if err != nil {
+		err = c.containerError(err, "memory usage")
+		return
+	}
+	limitMsg := fmt.Sprintf("limit %.0f Mb", float64(limit)/1024/1024)
+	if limit == 0 {
+		//not limited, the host memory is the limit
+		memstat, err := mem.VirtualMemory()
+		if err != nil {
+			return result, c.containerError(err, "memory usage")
+		}
+		limit = memstat.Total
+		limitMsg = "not limited"
+	}
+	result.Value = float64(usage) / float64(limit) * 100
+	severity, threshold := c.metric.severityAbove(result.Value)
+	result.Severity = severity
+	if severity != SeverityOK {
+		result.Message = fmt.Sprintf("Memory usage of %s %.2f%% of its limit is too high, over %.2f%% threshold", c.container(), result.Value, threshold)
+	} else {
+		result.Message = fmt.Sprintf("Memory usage of %s %.2f%% of its limit is back to normal, less than %.2f%% threshold", c.container(), result.Value, threshold)
+	}
+	result.MsgStatus = fmt.Sprintf("CONTAINER: %s uses %.0f Mb of memory (%.2f%%), %s", c.container(), float64(usage)/1024/1024, result.Value, limitMsg)
+	return
+}
+
+type containerOOMCheck struct {
+	*baseCheck
+	cgroupRate
+}
+
+func (c *containerOOMCheck) Run(ctx context.Context) (result Result, err error) {
+	g, err := c.containerCgroup(ctx)
+	if err != nil {
+		err = c.containerError(err, "OOM kills")
+		return
+	}
+	kills, err := g.oomKills()
+	if err != nil {
+		err = c.containerError(err, "OOM kills")
+		return
+	}
+	deltas, _, err := c.delta(kills)
+	if err != nil {
+		return
+	}
+	result.Value = float64(deltas[0])
+	severity, threshold := c.severityOfEvents(result.Value)
+	result.Severity = severity
+	if severity != SeverityOK {
+		result.Message = fmt.Sprintf("%.0f processes of %s were killed by the OOM killer, threshold %.0f", result.Value, c.container(), threshold)
+	} else {
+		result.Message = fmt.Sprintf("No more OOM kills in %s", c.container())
+	}
+	result.MsgStatus = fmt.Sprintf("CONTAINER: %s: %d OOM kills in total, %.0f since the previous check", c.container(), kills, result.Value)
+	return
+}
+
+type containerIOCheck struct {
+	*baseCheck
+	cgroupRate
+}
+
+func (c *containerIOCheck) Run(ctx context.Context) (result Result, err error) {
+	g, err := c.containerCgroup(ctx)
+	if err != nil {
+		err = c.containerError(err, "block IO")
+		return
+	}
+	read, written, err := g.io()
+	if err != nil {
+		err = c.containerError(err, "block IO")
+		return
+	}
+	deltas, seconds, err := c.delta(read, written)
+	if err != nil {
+		return
+	}
+	const divider = 1024 * 1024
+	reads := float64(deltas[0]) / seconds / divider
+	writes := float64(deltas[1]) / seconds / divider
+	result.Value = reads + writes
+	severity, threshold := c.metric.severityAbove(result.Value)
+	result.Severity = severity
+	if severity != SeverityOK {
+		result.Message = fmt.Sprintf("Block IO (reads + writes) of %s %.2f Mb/s is too high, over %.2f Mb/s threshold", c.container(), result.Value, threshold)
+	} else {
+		result.Message = fmt.Sprintf("Block IO (reads + writes) of %s %.2f Mb/s is back to normal, less than %.2f Mb/s threshold", c.container(), result.Value, threshold)
+	}
+	result.MsgStatus = fmt.Sprintf("CONTAINER: %s %.2f Mb/s reads, %.2f Mb/s writes, %.2f Mb/s total", c.container(), reads, writes, result.Value)
+	return
+}
+
+//containerStateCheck alerts if the Docker container is not running or restarts, the value is restarts since the previous check
+type containerStateCheck struct {
+	*baseCheck
+	cgroupRate
+}
+
+func (c *containerStateCheck) Run(ctx context.Context) (result Result, err error) {
+	if c.metric.Name == "" {
+		return result, fmt.Errorf("Set the container Name of %s", c.name)
+	}
+	container, err := inspectContainer(ctx, c.metric.Name)
+	if err != nil {
+		err = c.containerError(err, "state")
+		return
+	}
+	restarts := uint64(container.RestartCount)
+	deltas, _, err := c.delta(restarts)
+	if err == errFirstSample {
+		deltas, err = []uint64{0}, nil
+	}
+	if err != nil {
+		return
+	}
+	result.Value = float64(deltas[0])
+	result.MsgStatus = fmt.Sprintf("CONTAINER: %s is %s since %s, restarted %d times", c.metric.Name, container.State.Status, container.State.StartedAt.Format(time.RFC3339), restarts)
+	if !container.State.Running {
+		result.Severity = SeverityCritical
+		result.Message = fmt.Sprintf("Container %s is %s", c.metric.Name, container.State.Status)
+		if container.State.OOMKilled {
+			result.Message += ", killed by the OOM killer"
+		}
+		return
+	}
+	severity, _ := c.severityOfEvents(result.Value)
+	result.Severity = severity
+	if severity != SeverityOK {
+		result.Message = fmt.Sprintf("Container %s was restarted %.0f times", c.metric.Name, result.Value)
+	} else {
+		result.Message = fmt.Sprintf("Container %s is running", c.metric.Name)
+	}
+	return
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//clearGrace is how long the source of a sent alert has to be inactive before the alert is forgotten,
+//if its recovery was not sent (muted or cleared while ftvmon was stopped)
+const clearGrace = 10 * time.Minute
+
+//EscalationTier is notified if the alert is not acknowledged within After since it was first sent
+type EscalationTier struct {
+	After string   //Go duration, e.g. "10m", "" for the first tier
+	Users []string //usernames or onCallUser, all subscribers if empty
+	after time.Duration
+}
+
+//sentAlert is an active alert sent to subscribers, it is saved to escalationsFile to survive restarts
+type sentAlert struct {
+	ID            int
+	Key           string //alertKey() of the source
+	Host          string //agent which sent the alert, "" for this host
+	Check         string
+	Category      string
+	Severity      Severity
+	Text          string //of the last alert sent
+	Since         time.Time
+	Tier          int //the last notified tier, -1 if none
+	Recipients    []string
+	AckedBy       string
+	AckedAt       time.Time
+	inactiveSince time.Time
+}
+
+//escalationState is the content of escalationsFile
+type escalationState struct {
+	Alerts  []*sentAlert
+	Batches []*batch
+}
+
+//parse checks the tier, onCall is false if OnCall is not configured
+func (tier *EscalationTier) parse(onCall bool) (err error) {
+	for _, u := range tier.Users {
+		//an empty username would match the subscribers without usernames
+		if u == "" {
+			return fmt.Errorf("Empty username in escalation Users")
+		}
+		if strings.EqualFold(u, onCallUser) && !onCall {
+			return fmt.Errorf("Escalation Users has %q, but OnCall is not configured", u)
+		}
+	}
+	if tier.After == "" {
+		return
+	}
+	tier.after, err = time.ParseDuration(tier.After)
+	if err != nil || tier.after < 0 {
+		err = fmt.Errorf("Invalid escalation After %q", tier.After)
+	}
+	return
+}
+
+//escalationTiers returns the configured tiers. If none, the user on call is notified first (if OnCall is configured),
+//everyone otherwise
+func (monitor *Monitor) escalationTiers() []*EscalationTier {
+	if len(monitor.Escalation) > 0 {
+		return monitor.Escalation
+	}
+	onCallMutex.Lock()
+	defer onCallMutex.Unlock()
+	if monitor.OnCall != nil {
+		return []*EscalationTier{{Users: []string{onCallUser}}, {after: onCallEscalation}}
+	}
+	return []*EscalationTier{{}}
+}
+
+//subscribersOf returns IDs of the subscribers with the usernames, all the subscribers if usernames is empty
+//or if the user on duty in it has not subscribed
+func (monitor *Monitor) subscribersOf(usernames []string) (recipients []string) {
+	all := len(usernames) == 0
+	usernames, onDuty := monitor.resolveOnCall(usernames)
+	if !all && len(usernames) == 0 {
+		return
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if onDuty != "" {
+		subscribed := false
+		for _, s := range monitor.subscribers {
+			subscribed = subscribed || monitor.usernames[s] == onDuty
+		}
+		if !subscribed {
+			//nobody would be paged otherwise
+			logTelegram.Warnf("%s is on call, but has not subscribed, sending to all subscribers", onDuty)
+			all = true
+		}
+	}
+	for _, s := range monitor.subscribers {
+		if _, found := find(usernames, monitor.usernames[s]); found || all {
+			recipients = append(recipients, s)
+		}
+	}
+	return
+}
+
+//sendAlert queues the alert to the recipients, it gets the Acknowledge button unless it is acknowledged
+func (monitor *Monitor) sendAlert(sent *sentAlert, recipients []string) {
+	for _, recipient := range recipients {
+		monitor.enqueue(recipient, batchItem{sent.Host, sent.Category, sent.Severity, sent.Text, sent.ID})
+	}
+}
+
+//escalateTo notifies the tiers which are due, returns false if there were none
+func (monitor *Monitor) escalateTo(sent *sentAlert, now time.Time) (escalated bool) {
+	tiers := monitor.escalationTiers()
+	//tiers without subscribed users are skipped, until somebody is notified
+	for sent.Tier+1 < len(tiers) && (now.Sub(sent.Since) >= tiers[sent.Tier+1].after || len(sent.Recipients) == 0) {
+		sent.Tier++
+		var recipients []string
+		for _, r := range monitor.subscribersOf(tiers[sent.Tier].Users) {
+			if _, found := find(sent.Recipients, r); !found {
+				recipients = append(recipients, r)
+			}
+		}
+		if sent.Tier > 0 && len(recipients) > 0 {
+			logTelegram.Infof("Escalating to tier %d: %s", sent.Tier+1, sent.Text)
+		}
+		sent.Recipients = append(sent.Recipients, recipients...)
+		monitor.sendAlert(sent, recipients)
+		escalated = true
+	}
+	return
+}
+
+//sendEscalated sends an alert which can be acknowledged to the tiers notified so far,
+//a recovery goes to everybody who got the alert
+func (monitor *Monitor) sendEscalated(alert Alert) {
+	key := alert.source.alertKey()
+	item := batchItem{alert.Host, alert.Category, alert.Severity, alert.Text, 0}
+	ackMutex.Lock()
+	defer ackMutex.Unlock()
+	var sent *sentAlert
+	for _, s := range monitor.sentAlerts {
+		if s.Key == key {
+			sent = s
+			break
+		}
+	}
+	if alert.Severity == SeverityOK {
+		if sent == nil {
+			for _, recipient := range monitor.subscribersOf(nil) {
+				monitor.enqueue(recipient, item)
+			}
+			return
+		}
+		for _, recipient := range sent.Recipients {
+			monitor.enqueue(recipient, item)
+		}
+		delete(monitor.sentAlerts, sent.ID)
+		monitor.saveSentAlerts()
+		return
+	}
+	if sent == nil {
+		monitor.lastAlertID++
+		sent = &sentAlert{ID: monitor.lastAlertID, Key: key, Host: alert.Host, Check: alert.Check, Category: alert.Category,
+			Severity: alert.Severity, Text: alert.Text, Since: time.Now(), Tier: -1}
+		monitor.sentAlerts[sent.ID] = sent
+		monitor.escalateTo(sent, time.Now())
+		monitor.saveSentAlerts()
+		return
+	}
+	//acknowledgement is lost by the source on restart
+	if sent.AckedBy != "" && alert.source.acknowledged() == "" {
+		alert.source.acknowledge(sent.AckedBy)
+	}
+	sent.Category = alert.Category
+	sent.Severity = alert.Severity
+	sent.Text = alert.Text
+	monitor.sendAlert(sent, sent.Recipients)
+	monitor.saveSentAlerts()
+}
+
+//escalate notifies the next tiers of alerts which are not acknowledged in time, called by msgDispatcher
+func (monitor *Monitor) escalate(now time.Time) {
+	ackMutex.Lock()
+	defer ackMutex.Unlock()
+	changed := false
+	for id, sent := range monitor.sentAlerts {
+		source := monitor.alertSource(sent.Key)
+		if source == nil {
+			delete(monitor.sentAlerts, id)
+			changed = true
+			continue
+		}
+		if !source.active() {
+			if sent.inactiveSince.IsZero() {
+				sent.inactiveSince = now
+			} else if now.Sub(sent.inactiveSince) >= clearGrace {
+				delete(monitor.sentAlerts, id)
+				changed = true
+			}
+			continue
+		}
+		sent.inactiveSince = time.Time{}
+		if sent.AckedBy != "" || monitor.muted(sent.Check) {
+			continue
+		}
+		if monitor.escalateTo(sent, now) {
+			changed = true
+		}
+	}
+	if changed {
+		monitor.saveSentAlerts()
+	}
+}
+
+//saveSentAlerts writes active alerts and their messages to escalationsFile, ackMutex has to be locked
+func (monitor *Monitor) saveSentAlerts() {
+	var state escalationState
+	for _, sent := range monitor.sentAlerts {
+		state.Alerts = append(state.Alerts, sent)
+	}
+	sort.Slice(state.Alerts, func(i, j int) bool { return state.Alerts[i].ID < state.Alerts[j].ID })
+	//messages of cleared alerts are not edited anymore
+	for key, b := range monitor.batches {
+		active := false
+		for _, item := range b.Items {
+			if _, found := monitor.sentAlerts[item.AlertID]; found {
+				active = true
+				break
+			}
+		}
+		if !active {
+			delete(monitor.batches, key)
+			continue
+		}
+		state.Batches = append(state.Batches, b)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		logTelegram.Errorf("Error encoding active alerts: %s", err)
+		return
+	}
+	tmp := monitor.escalationsFile + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, monitor.escalationsFile)
+	}
+	if err != nil {
+		logTelegram.Errorf("Error saving active alerts: %s", err)
+	}
+}
+
+//loadSentAlerts restores active alerts and their escalation state saved before restart
+func (monitor *Monitor) loadSentAlerts() {
+	monitor.sentAlerts = make(map[int]*sentAlert)
+	monitor.batches = make(map[string]*batch)
+	data, err := ioutil.ReadFile(monitor.escalationsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logTelegram.Errorf("Error reading active alerts: %s", err)
+		}
+		return
+	}
+	var state escalationState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		logTelegram.Errorf("Error decoding active alerts: %s", err)
+		return
+	}
+	for _, sent := range state.Alerts {
+		monitor.sentAlerts[sent.ID] = sent
+		if sent.ID > monitor.lastAlertID {
+			monitor.lastAlertID = sent.ID
+		}
+	}
+	for _, b := range state.Batches {
+		monitor.batches[messageKey(b.Message)] = b
+	}
+	logTelegram.Infof("Loaded %d active alerts", len(state.Alerts))
+}
@@ -2,15 +2,17 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
-	"reflect"
 	"regexp"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/hpcloud/tail"
@@ -29,31 +31,96 @@ type subscriber string
 type Monitor struct {
 	Token           string
 	Authorized      []string
+	Admins          []string
 	TonPath         string
 	KeysPath        string
-	Logfiles        []Logfile
+	Node            *Node //the node queried by ExtChecks, the C++ node with the default settings if not set
+	NotifyStop      bool
+	Logging         Logging
+	StateDir        string //subscribers, alert state, escalations and the outbox are kept in it, "" - current directory
+	HTTP            *HTTP  //serves /metrics and /status, not started if nil
+	Zabbix          *Zabbix
+	Agent           *Agent  //agent mode: alerts are sent to the server, not to telegram
+	Server          *Server //server mode: alerts of the agents are sent to telegram too
+	agents          map[string]*remoteAgent
+	Escalation      []*EscalationTier
+	OnCall          *OnCall
+	BatchWindow     string //Go duration, alerts arriving within it are sent in one message, "" - no batching
+	batchWindow     time.Duration
+	Maintenance     []*Maintenance
+	Logfiles        []*Logfile
 	Checks          map[string]*Metric
 	ExtChecks       map[string]*Metric
+	configFile      string
+	httpServer      *http.Server
 	subscribersFile string
+	stateFile       string
 	subscribers     []string
 	bot             *tb.Bot
-	prQueue         chan string
+	prQueue         chan Alert
+	queueClosed     bool //set when prQueue is closed
+	updates         chan *Metric
+	zabbixPush      chan struct{} //alert state changes are pushed to Zabbix before Interval, nil without Zabbix
 	hostname        string
+	running         map[interface{}]*runner
+	mutes           map[string]*mute
+	usernames       map[string]string //subscriber ID -> username
+	escalationsFile string
+	sentAlerts      map[int]*sentAlert
+	lastAlertID     int
+	batches         map[string]*batch
+	pending         map[string]*pendingBatch
+	outboxFile      string
+	outbox          []*outMessage
+	outboxDirty     time.Time //of the first change which is not saved, zero if none
+	lastOutID       int
+	outboxReady     chan struct{}
+	handoversFile   string
+	handovers       []*Override //made by /handover
 }
 
 type Metric struct {
 	Enabled   bool
-	Threshold float64
+	Threshold float64 //used as the critical threshold if Critical is not set
+	Warning   *float64
+	Critical  *float64
 	Path      string
 	Dev       string
 	Name      string
+	Interval  string //Go duration, e.g. "10s" or "5m", defaults to 5s for Checks and 1m for ExtChecks
+	//number of samples ("3") or duration ("2m") the alert condition has to hold before it is reported
+	For string
+	//number of samples or duration the cleared condition has to hold before it is reported
+	ClearFor string
+	//alert clears only when the value crosses ClearThreshold, not the lowest threshold (hysteresis)
+	ClearThreshold *float64
+	//Go duration, re-send the alert while it is active, "" - send once
+	RepeatEvery string
 	sync.Mutex
-	message       string
-	msgStatus     string
-	adnlChanged   bool
-	lastBlockTime int64
-	lastState     bool
-	status        bool
+	name            string
+	category        string
+	interval        time.Duration
+	forAlert        hold
+	repeatEvery     time.Duration
+	alertSince      time.Time
+	lastSent        time.Time
+	lastMessage     string
+	ackedBy         string
+	clearFor        hold
+	pendingSince    time.Time
+	pendingSamples  int
+	pendingSeverity Severity
+	message         string
+	msgStatus       string
+	adnlChanged     bool
+	lastBlockTime   int64
+	lastSeverity    Severity
+	severity        Severity
+	value           float64
+	updated         time.Time //of the last measurement
+	failure         string
+	lastBroken      bool
+	broken          bool
 }
 
 type Logfile struct {
@@ -71,10 +138,21 @@ type LogEvent struct {
 	Threshold  int //number of events with Match in log, during Window, to trigger sending MessageOn
 	Window     int //minutes, if 0 - trigger MessageOn every time the event occurs (no MessageOff)
 	IncludeRaw bool
-	re         *regexp.Regexp
+	Severity   string //of MessageOn: "warning", "critical" or "" for no severity prefix
+	//Go duration, re-send MessageOn while the event is above Threshold (Window > 0 only), "" - send once
+	RepeatEvery string
+	severity    Severity
+	repeatEvery time.Duration
+	alertSince  time.Time
+	lastSent    time.Time
+	lastMessage string
+	ackedBy     string
+	key         string //file and Match
+	re          *regexp.Regexp
 	sync.Mutex
 	events     []logRecord
 	lastState  bool
+	matched    uint64 //lines matched since start
 	eventQueue chan string
 }
 
@@ -98,7 +176,7 @@ func find(slice []string, val string) (int, bool) {
 }
 
 func sliceToFile(slice []string, file string) (err error) {
-	f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := os.OpenFile(file, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
 	datawriter := bufio.NewWriter(f)
 	for _, data := range slice {
 		_, _ = datawriter.WriteString(data + "\n")
@@ -118,16 +196,22 @@ func (entry *LogEvent) isThresholdReached() bool {
 	return false
 }
 
-func (monitor *Monitor) logWorker(entry *LogEvent) {
+func (monitor *Monitor) logWorker(ctx context.Context, entry *LogEvent) {
 	defer wg.Done()
 	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
 	for {
+		//state is locked for saveState() and acknowledgement, alerts are queued without blocking
+		changed := false
 		select {
+		case <-ctx.Done():
+			return
 		case <-ticker.C:
 			now := time.Now()
 			//log.Printf("now: %s", now.Format(time.RFC3339))
 			limitTS := now.Add(time.Duration(-entry.Window) * time.Minute)
 			//log.Printf("limitTS: %s", limitTS.Format(time.RFC3339))
+			entry.Lock()
 			var freshEvents []logRecord
 			//needs optimization
 			for _, e := range entry.events {
@@ -140,99 +224,171 @@ func (monitor *Monitor) logWorker(entry *LogEvent) {
 			copy(entry.events, freshEvents)
 			currentState := entry.isThresholdReached()
 			if !currentState && entry.lastState {
-				monitor.prQueue <- fmt.Sprintf("LOGS: %s", entry.MessageOff)
+				monitor.queue(Alert{Check: logsCheck, Category: "LOGS", Severity: SeverityOK, Text: entry.MessageOff, source: entry})
 				entry.lastState = false
+				entry.ackedBy = ""
+				changed = true
 			}
+			if entry.lastState && entry.repeatEvery > 0 && now.Sub(entry.lastSent) >= entry.repeatEvery && entry.ackedBy == "" {
+				monitor.queue(Alert{Check: logsCheck, Category: "LOGS", Severity: entry.severity, Text: activeFor(entry.lastMessage, entry.alertSince), source: entry})
+				entry.lastSent = now
+				changed = true
+			}
+			entry.Unlock()
 		case raw := <-entry.eventQueue:
 			event := logRecord{raw, time.Now()}
+			entry.Lock()
 			entry.events = append(entry.events, event)
+			entry.matched++
 			currentState := entry.isThresholdReached()
 			if currentState && !entry.lastState {
+				message := entry.MessageOn
 				if entry.IncludeRaw {
-					monitor.prQueue <- fmt.Sprintf("LOGS: %s: %s", entry.MessageOn, raw)
-				} else {
-					monitor.prQueue <- fmt.Sprintf("LOGS: %s", entry.MessageOn)
+					message = fmt.Sprintf("%s: %s", entry.MessageOn, raw)
 				}
-				if entry.Window > 0 {
+				if entry.Window == 0 {
+					monitor.queue(Alert{Check: logsCheck, Category: "LOGS", Severity: entry.severity, Text: message})
+				} else {
+					monitor.queue(Alert{Check: logsCheck, Category: "LOGS", Severity: entry.severity, Text: message, source: entry})
 					entry.lastState = true
+					entry.alertSince = event.eventTS
+					entry.lastSent = event.eventTS
+					entry.lastMessage = message
+					changed = true
 				}
 			}
+			entry.Unlock()
+		}
+		if changed {
+			monitor.saveState()
+			monitor.pushToZabbix()
 		}
 	}
 }
 
+//msgDispatcher sends messages to subscribers until prQueue is closed, messages of muted checks are suppressed.
+//Messages arriving within BatchWindow are consolidated, critical alerts are sent immediately
 func (monitor *Monitor) msgDispatcher() {
-	defer wg.Done()
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	batchTicker := time.NewTicker(time.Second)
+	defer batchTicker.Stop()
 	for {
 		select {
-		case message, ok := <-monitor.prQueue:
+		case alert, ok := <-monitor.prQueue:
 			if !ok {
+				monitor.flushBatches(time.Now(), true)
 				return
 			}
-			mutex.Lock()
-			buf := make([]string, len(monitor.subscribers))
-			copy(buf, monitor.subscribers)
-			mutex.Unlock()
-			if len(buf) > 0 {
-				for _, recipient := range buf {
-					monitor.bot.Send(subscriber(recipient), monitor.hostname+": "+message)
-				}
+			if monitor.suppress(alert) {
+				logTelegram.Infof("Muted: %s", alert)
+				continue
+			}
+			monitor.broadcast(alert)
+		case now := <-ticker.C:
+			for _, summary := range monitor.updateMutes(now) {
+				monitor.broadcast(summary)
+			}
+			if alert, ok := monitor.droppedAlert(); ok {
+				monitor.broadcast(alert)
 			}
+			monitor.escalate(now)
+		case <-batchTicker.C:
 		}
+		monitor.flushBatches(time.Now(), false)
 	}
 }
 
-func (monitor *Monitor) subscribe(user *tb.User) (err error) {
+//broadcast sends the alert to all subscribers, alerts which can be acknowledged are escalated (see escalation.go)
+func (monitor *Monitor) broadcast(alert Alert) {
+	if alert.source != nil {
+		monitor.sendEscalated(alert)
+		return
+	}
+	for _, recipient := range monitor.subscribersOf(nil) {
+		monitor.enqueue(recipient, batchItem{alert.Host, alert.Category, alert.Severity, alert.Text, 0})
+	}
+}
+
+func (monitor *Monitor) isAuthorized(user *tb.User) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
 	_, found := find(monitor.Authorized, user.Username)
-	if !found {
+	return found
+}
+
+func (monitor *Monitor) isAdmin(user *tb.User) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, found := find(monitor.Admins, user.Username)
+	return found
+}
+
+func (monitor *Monitor) subscribe(user *tb.User) (err error) {
+	if !monitor.isAuthorized(user) {
 		err = fmt.Errorf("User %s is not authorized", user.Username)
 		return
 	}
-	log.Printf("Found authorized user in conf: %+s\n", user.Username)
-	_, found = find(monitor.subscribers, fmt.Sprintf("%d", user.ID))
+	logTelegram.Debugf("Found authorized user in conf: %s", user.Username)
+	id := fmt.Sprintf("%d", user.ID)
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, found := find(monitor.subscribers, id)
+	if found && monitor.usernames[id] == user.Username {
+		logTelegram.Debugf("User already subscribed: %d", user.ID)
+		return
+	}
 	if !found {
-		log.Printf("Not subscribed yet: %d\n", user.ID)
-		mutex.Lock()
-		monitor.subscribers = append(monitor.subscribers, fmt.Sprintf("%d", user.ID))
-		mutex.Unlock()
-		err = sliceToFile(monitor.subscribers, monitor.subscribersFile)
-		if err != nil {
-			log.Println("Error creating subscribers file:", err)
+		logTelegram.Infof("New subscriber %s: %d", user.Username, user.ID)
+		monitor.subscribers = append(monitor.subscribers, id)
+	}
+	//usernames are needed to resolve escalation tiers
+	monitor.usernames[id] = user.Username
+	lines := make([]string, len(monitor.subscribers))
+	for i, s := range monitor.subscribers {
+		lines[i] = strings.TrimSpace(s + " " + monitor.usernames[s])
+	}
+	err = sliceToFile(lines, monitor.subscribersFile)
+	if err != nil {
+		logTelegram.Errorf("Error creating subscribers file: %s", err)
+	}
+	return
+}
+
+//statusMessages returns the status of the checks which have one
+func (monitor *Monitor) statusMessages() (messages []string) {
+	checksMutex.RLock()
+	defer checksMutex.RUnlock()
+	for _, checks := range []map[string]*Metric{monitor.Checks, monitor.ExtChecks} {
+		for _, metric := range checks {
+			metric.Lock()
+			msg := metric.msgStatus
+			metric.Unlock()
+			if msg != "" {
+				messages = append(messages, msg)
+			}
 		}
-	} else {
-		log.Printf("User already subscribed: %d\n", user.ID)
 	}
 	return
 }
 
 func (monitor *Monitor) status(user *tb.User) (err error) {
-	_, found := find(monitor.Authorized, user.Username)
-	if !found {
+	if !monitor.isAuthorized(user) {
 		err = fmt.Errorf("User %s is not authorized", user.Username)
 		return
 	}
-	for _, metric := range monitor.Checks {
-		metric.Lock()
-		msg := metric.msgStatus
-		metric.Unlock()
-		if msg != "" {
-			monitor.bot.Send(user, monitor.hostname+": "+msg)
-		}
+	for _, msg := range monitor.statusMessages() {
+		monitor.bot.Send(user, monitor.hostname+": "+msg)
 	}
-	for _, metric := range monitor.ExtChecks {
-		metric.Lock()
-		msg := metric.msgStatus
-		metric.Unlock()
-		if msg != "" {
-			monitor.bot.Send(user, monitor.hostname+": "+msg)
-		}
+	for _, msg := range monitor.agentStatus() {
+		monitor.bot.Send(user, msg)
 	}
 	return
 }
 
-func (monitor *Monitor) tailLog(logfile *Logfile) {
+func (monitor *Monitor) tailLog(ctx context.Context, logfile *Logfile) {
 	defer wg.Done()
-	defer log.Printf("Exiting a goroutine for %s...\n", logfile.File)
+	defer logLogs.Infof("Exiting a goroutine for %s...", logfile.File)
 	t, err := tail.TailFile(logfile.File, tail.Config{
 		Follow:    true,
 		ReOpen:    true,
@@ -240,23 +396,35 @@ func (monitor *Monitor) tailLog(logfile *Logfile) {
 		Location:  &tail.SeekInfo{Whence: 2},
 	})
 	if err != nil {
-		log.Println("Error: ", err)
+		logLogs.With("file", logfile.File).Errorf("Error tailing the log: %s", err)
 		return
 	}
+	defer t.Cleanup()
+	defer t.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case line := <-t.Lines:
-			for n, _ := range logfile.Events {
+			for n := range logfile.Events {
 				if logfile.Events[n].Enabled == true {
 					if logfile.Events[n].IsRegex {
 						if logfile.Events[n].re.MatchString(line.Text) {
-							log.Printf("%s event in the log %s: %s\n", logfile.Events[n].Match, logfile.File, line.Text)
-							logfile.Events[n].eventQueue <- line.Text
+							logLogs.With("file", logfile.File, "match", logfile.Events[n].Match).Debugf("Event in the log: %s", line.Text)
+							select {
+							case logfile.Events[n].eventQueue <- line.Text:
+							case <-ctx.Done():
+								return
+							}
 						}
 					} else {
 						if strings.Contains(line.Text, logfile.Events[n].Match) {
-							log.Printf("%s event in the log %s: %s\n", logfile.Events[n].Match, logfile.File, line.Text)
-							logfile.Events[n].eventQueue <- line.Text
+							logLogs.With("file", logfile.File, "match", logfile.Events[n].Match).Debugf("Event in the log: %s", line.Text)
+							select {
+							case logfile.Events[n].eventQueue <- line.Text:
+							case <-ctx.Done():
+								return
+							}
 						}
 					}
 				}
@@ -265,93 +433,188 @@ func (monitor *Monitor) tailLog(logfile *Logfile) {
 	}
 }
 
-func (Monitor *Monitor) checker() {
+//checker sends a message when the state of a metric changes, metrics are passed by the checks after every measurement
+func (monitor *Monitor) checker(ctx context.Context) {
 	defer wg.Done()
-	//checking for changes every 5 second
-	ticker := time.NewTicker(5 * time.Second)
-	flaunch := func(checks map[string]*Metric) {
-		for n, m := range checks {
-			name := n
-			metric := m
-			if metric.Enabled {
-				f := func() {
-					v := reflect.ValueOf(Monitor)
-					_ = v.MethodByName(name).Call(nil)
-				}
-				go f()
+	//alerts are returned and sent with the metric unlocked, as msgDispatcher locks the metric to check acknowledgement
+	fcheck := func(metric *Metric) (alerts []Alert) {
+		metric.Lock()
+		defer metric.Unlock()
+		if metric.broken != metric.lastBroken {
+			alert := Alert{Check: metric.name, Category: "CHECK", Severity: SeverityOK, Text: fmt.Sprintf("Check %s recovered", metric.name)}
+			if metric.broken {
+				alert = Alert{Check: metric.name, Category: "CHECK", Severity: SeverityWarning, Text: fmt.Sprintf("Check %s is broken: %s", metric.name, metric.failure)}
 			}
+			logChecks.With("check", metric.name).Infof("%s", alert)
+			alerts = append(alerts, alert)
+			metric.lastBroken = metric.broken
 		}
-	}
-	fcheck := func(checks map[string]*Metric) {
-		for _, metric := range checks {
-			if metric.Enabled {
-				metric.Lock()
-				if metric.status != metric.lastState {
-					//if status changed, metric.message is not empty ""
-					log.Println(Monitor.hostname + ": " + metric.message)
-					Monitor.prQueue <- metric.message
-					metric.lastState = !metric.lastState
-				}
-				metric.Unlock()
+		if metric.broken {
+			return
+		}
+		if severity, changed := metric.nextSeverity(); changed {
+			//if severity changed, metric.message is not empty ""
+			alert := Alert{Check: metric.name, Category: metric.category, Severity: severity, Text: metric.message, source: metric}
+			logChecks.With("check", metric.name).Infof("%s", alert)
+			alerts = append(alerts, alert)
+			if metric.lastSeverity == SeverityOK {
+				metric.alertSince = time.Now()
 			}
+			if severity == SeverityOK {
+				metric.ackedBy = ""
+			}
+			metric.lastSeverity = severity
+			metric.lastSent = time.Now()
+			metric.lastMessage = metric.message
+			return
+		}
+		if metric.lastSeverity != SeverityOK && metric.repeatEvery > 0 && time.Since(metric.lastSent) >= metric.repeatEvery && metric.ackedBy == "" {
+			message := metric.lastMessage
+			if metric.severity == metric.lastSeverity {
+				message = metric.message
+			}
+			alerts = append(alerts, Alert{Check: metric.name, Category: metric.category, Severity: metric.lastSeverity, Text: activeFor(message, metric.alertSince), source: metric})
+			metric.lastSent = time.Now()
 		}
+		return
 	}
-	flaunch(Monitor.Checks)
-	flaunch(Monitor.ExtChecks)
 	for {
 		select {
-		case <-ticker.C:
-			fcheck(Monitor.Checks)
-			fcheck(Monitor.ExtChecks)
+		case <-ctx.Done():
+			return
+		case metric := <-monitor.updates:
+			alerts := fcheck(metric)
+			for _, alert := range alerts {
+				monitor.queue(alert)
+			}
+			if len(alerts) > 0 {
+				monitor.saveState()
+				monitor.pushToZabbix()
+			}
+		}
+	}
+}
+
+//start starts the log tails, the checks and the exporters
+func (monitor *Monitor) start(ctx context.Context) {
+	reloadMutex.Lock()
+	for _, logfile := range monitor.Logfiles {
+		monitor.startLogfile(ctx, logfile)
+	}
+	monitor.startChecks(ctx)
+	reloadMutex.Unlock()
+	wg.Add(1)
+	go monitor.checker(ctx)
+	if monitor.HTTP != nil {
+		err := monitor.startHTTP()
+		if err != nil {
+			logMain.Errorf("Error starting HTTP listener: %s", err)
+		}
+	}
+	if monitor.Zabbix != nil {
+		wg.Add(1)
+		go monitor.zabbixSender(ctx)
+	}
+}
+
+//waitForStop reloads the config on SIGHUP and returns on SIGINT or SIGTERM
+func (monitor *Monitor) waitForStop(ctx context.Context, signals chan os.Signal) {
+	var sig os.Signal
+	for sig = range signals {
+		if sig != syscall.SIGHUP {
+			break
+		}
+		logMain.Infof("Got SIGHUP, reloading config...")
+		err := monitor.reload(ctx)
+		if err != nil {
+			logMain.Errorf("Error reloading config: %s", err)
 		}
 	}
+	logMain.Infof("Got %s, stopping...", sig)
+	//a second signal kills the process if stopping hangs
+	signal.Stop(signals)
 }
 
 func main() {
 	//go func() {
 	//	log.Println(http.ListenAndServe("10.1.2.1:6060", nil))
 	//}()
-	var monitor Monitor
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	//cleanup
 	//_ = os.Remove("current")
 	//_ = os.Remove("previous")
-	infostat, err := host.Info()
+	monitor, err := readConfig("conf.json")
 	if err != nil {
-		log.Println("Error: ", err)
+		log.Println(err)
+		return
 	}
-	monitor.hostname = infostat.Hostname
-	monitor.subscribersFile = "subscribers"
-	monitor.prQueue = make(chan string, 100)
-	configFile, err := os.Open("conf.json")
+	err = setupLogging(monitor.Logging)
 	if err != nil {
-		log.Println("No config file: ", err)
+		log.Println(err)
 		return
 	}
-	defer configFile.Close()
-	decoder := json.NewDecoder(configFile)
-	err = decoder.Decode(&monitor)
+	infostat, err := host.Info()
 	if err != nil {
-		log.Println("Error decoding config file: ", err)
-		return
+		logMain.Errorf("Error getting host info: %s", err)
+	}
+	monitor.hostname = infostat.Hostname
+	monitor.configFile = "conf.json"
+	if monitor.StateDir != "" {
+		err = os.MkdirAll(monitor.StateDir, 0755)
+		if err != nil {
+			logMain.Errorf("Error creating state directory: %s", err)
+			return
+		}
 	}
-	if monitor.TonPath != "" {
-		monitor.TonPath = filepath.Clean(monitor.TonPath)
+	monitor.subscribersFile = filepath.Join(monitor.StateDir, "subscribers")
+	monitor.stateFile = filepath.Join(monitor.StateDir, "state.json")
+	monitor.loadState()
+	monitor.prQueue = make(chan Alert, 100)
+	monitor.updates = make(chan *Metric)
+	if monitor.Zabbix != nil {
+		monitor.zabbixPush = make(chan struct{}, 1)
 	}
-	if monitor.KeysPath != "" {
-		monitor.KeysPath = filepath.Clean(monitor.KeysPath)
+	monitor.running = make(map[interface{}]*runner)
+	monitor.mutes = make(map[string]*mute)
+	monitor.usernames = make(map[string]string)
+	monitor.agents = make(map[string]*remoteAgent)
+	if monitor.Agent != nil {
+		monitor.runAgent(ctx, cancel, signals)
+		return
 	}
+	monitor.escalationsFile = filepath.Join(monitor.StateDir, "escalations.json")
+	monitor.loadSentAlerts()
+	monitor.pending = make(map[string]*pendingBatch)
+	monitor.outboxFile = filepath.Join(monitor.StateDir, "outbox.json")
+	monitor.outboxReady = make(chan struct{}, 1)
+	monitor.loadOutbox()
+	monitor.handoversFile = filepath.Join(monitor.StateDir, "handovers.json")
+	monitor.loadHandovers()
 	sFile, err := os.Open(monitor.subscribersFile)
 	if err != nil {
-		log.Println("No subscribers yet, use /subscribe")
+		logTelegram.Warnf("No subscribers yet, use /subscribe")
 	} else {
 		fileScanner := bufio.NewScanner(sFile)
 		fileScanner.Split(bufio.ScanLines)
 		for fileScanner.Scan() {
-			monitor.subscribers = append(monitor.subscribers, fileScanner.Text())
+			//"ID username", older files have IDs only
+			fields := strings.Fields(fileScanner.Text())
+			if len(fields) == 0 {
+				continue
+			}
+			if _, found := find(monitor.subscribers, fields[0]); !found {
+				monitor.subscribers = append(monitor.subscribers, fields[0])
+			}
+			if len(fields) > 1 {
+				monitor.usernames[fields[0]] = fields[1]
+			}
 		}
 		sFile.Close()
 		for _, eachline := range monitor.subscribers {
-			log.Printf("Found a subscriber with ID: %s\n", eachline)
+			logTelegram.Infof("Found a subscriber with ID: %s", eachline)
 		}
 	}
 	monitor.bot, err = tb.NewBot(tb.Settings{
@@ -359,58 +622,159 @@ func main() {
 		Poller: &tb.LongPoller{Timeout: 10 * time.Second},
 	})
 	if err != nil {
-		log.Println("Error creating monitor: ", err)
+		logTelegram.Errorf("Error creating monitor: %s", err)
 		return
 	}
 	monitor.bot.Handle("/subscribe", func(m *tb.Message) {
 		err := monitor.subscribe(m.Sender)
 		if err != nil {
-			log.Println("Error subscribing: ", err)
+			logTelegram.Warnf("Error subscribing: %s", err)
 			monitor.bot.Send(m.Sender, "Not authorized.")
 		} else {
 			monitor.bot.Send(m.Sender, "Subscribed to updates!")
 		}
 		for _, eachline := range monitor.subscribers {
-			log.Printf("Found a subscriber with ID: %s\n", eachline)
+			logTelegram.Debugf("Found a subscriber with ID: %s", eachline)
 		}
 	})
 	monitor.bot.Handle("/status", func(m *tb.Message) {
 		err := monitor.status(m.Sender)
 		if err != nil {
-			log.Println("Error sending status: ", err)
+			logTelegram.Warnf("Error sending status: %s", err)
 		}
 	})
-	wg.Add(1)
-	go monitor.bot.Start()
-	for i, l := range monitor.Logfiles {
-		if l.Enabled {
-		Label:
-			for k, e := range l.Events {
-				if e.Enabled {
-					if e.IsRegex {
-						log.Printf("Compiling regex %s...\n", monitor.Logfiles[i].Events[k].Match)
-						monitor.Logfiles[i].Events[k].re, err = regexp.Compile(monitor.Logfiles[i].Events[k].Match)
-						if err != nil {
-							log.Printf("Failed to compile regex %s, removed the event from checking \n", monitor.Logfiles[i].Events[k].Match)
-							monitor.Logfiles[i].Events[k].Enabled = false
-							continue Label
-						}
-					}
-					monitor.Logfiles[i].Events[k].Lock()
-					monitor.Logfiles[i].Events[k].eventQueue = make(chan string)
-					monitor.Logfiles[i].Events[k].Unlock()
-					wg.Add(1)
-					go monitor.logWorker(&monitor.Logfiles[i].Events[k])
-				}
+	monitor.bot.Handle(&ackButton, monitor.onAcknowledge)
+	monitor.bot.Handle("/oncall", func(m *tb.Message) {
+		if !monitor.isAuthorized(m.Sender) {
+			monitor.bot.Send(m.Sender, "Not authorized.")
+			return
+		}
+		monitor.bot.Send(m.Sender, monitor.onCallStatus())
+	})
+	monitor.bot.Handle("/handover", func(m *tb.Message) {
+		if !monitor.isAuthorized(m.Sender) {
+			monitor.bot.Send(m.Sender, "Not authorized.")
+			return
+		}
+		to := strings.TrimPrefix(strings.TrimSpace(m.Payload), "@")
+		if to == "" {
+			monitor.bot.Send(m.Sender, "Usage: /handover <username>")
+			return
+		}
+		mutex.Lock()
+		_, found := find(monitor.Authorized, to)
+		mutex.Unlock()
+		if !found {
+			monitor.bot.Send(m.Sender, fmt.Sprintf("User %s is not authorized", to))
+			return
+		}
+		err := monitor.handover(m.Sender.Username, monitor.isAdmin(m.Sender), to)
+		if err != nil {
+			monitor.bot.Send(m.Sender, err.Error())
+			return
+		}
+		monitor.bot.Send(m.Sender, monitor.onCallStatus())
+	})
+	monitor.bot.Handle("/mute", func(m *tb.Message) {
+		if !monitor.isAuthorized(m.Sender) {
+			monitor.bot.Send(m.Sender, "Not authorized.")
+			return
+		}
+		args := strings.Fields(m.Payload)
+		if len(args) == 0 {
+			monitor.bot.Send(m.Sender, monitor.listMutes())
+			return
+		}
+		if len(args) != 2 {
+			monitor.bot.Send(m.Sender, "Usage: /mute <check|all> <duration>, e.g. /mute Sync 2h")
+			return
+		}
+		target, err := monitor.muteTarget(args[0])
+		if err != nil {
+			monitor.bot.Send(m.Sender, err.Error())
+			return
+		}
+		duration, err := time.ParseDuration(args[1])
+		if err != nil || duration <= 0 {
+			monitor.bot.Send(m.Sender, fmt.Sprintf("Invalid duration %s, use e.g. 30m or 2h", args[1]))
+			return
+		}
+		until := time.Now().Add(duration)
+		monitor.mute(target, until, "by "+m.Sender.Username)
+		logTelegram.Infof("%s muted by %s until %s", target, m.Sender.Username, until.Format(time.RFC3339))
+		monitor.bot.Send(m.Sender, fmt.Sprintf("%s muted until %s", target, until.Format(time.RFC3339)))
+	})
+	monitor.bot.Handle("/unmute", func(m *tb.Message) {
+		if !monitor.isAuthorized(m.Sender) {
+			monitor.bot.Send(m.Sender, "Not authorized.")
+			return
+		}
+		var target string
+		if m.Payload != "" {
+			var err error
+			target, err = monitor.muteTarget(strings.TrimSpace(m.Payload))
+			if err != nil {
+				monitor.bot.Send(m.Sender, err.Error())
+				return
 			}
-			log.Printf("Launching a goroutine for %s...\n", l.File)
-			wg.Add(1)
-			go monitor.tailLog(&monitor.Logfiles[i])
+		}
+		summaries := monitor.unmute(target)
+		if len(summaries) == 0 {
+			monitor.bot.Send(m.Sender, "Nothing to unmute")
+			return
+		}
+		logTelegram.Infof("Unmuted by %s: %s", m.Sender.Username, m.Payload)
+		for _, summary := range summaries {
+			monitor.queue(summary)
+		}
+	})
+	monitor.bot.Handle("/reload", func(m *tb.Message) {
+		if !monitor.isAdmin(m.Sender) {
+			monitor.bot.Send(m.Sender, "Not authorized.")
+			return
+		}
+		logMain.Infof("Reloading config, requested by %s...", m.Sender.Username)
+		err := monitor.reload(ctx)
+		if err != nil {
+			logMain.Errorf("Error reloading config: %s", err)
+			monitor.bot.Send(m.Sender, fmt.Sprintf("Config is not reloaded: %s", err))
+		} else {
+			monitor.bot.Send(m.Sender, "Config reloaded")
+		}
+	})
+	stopSender := make(chan struct{})
+	sent := make(chan struct{})
+	go func() {
+		monitor.sender(stopSender)
+		close(sent)
+	}()
+	dispatched := make(chan struct{})
+	go func() {
+		monitor.msgDispatcher()
+		close(dispatched)
+	}()
+	monitor.start(ctx)
+	if monitor.Server != nil {
+		err = monitor.serveAgents(ctx)
+		if err != nil {
+			logMain.Errorf("Error listening for agents: %s", err)
 		}
 	}
-	wg.Add(1)
-	go monitor.msgDispatcher()
-	wg.Add(1)
-	go monitor.checker()
+	go monitor.bot.Start()
+	monitor.waitForStop(ctx, signals)
+	cancel()
+	monitor.bot.Stop()
+	monitor.stopHTTP()
+	//all the goroutines sending to prQueue have to exit before it is closed
 	wg.Wait()
+	monitor.saveState()
+	if monitor.NotifyStop {
+		monitor.queue(Alert{Text: "Monitor stopping"})
+	}
+	monitor.closeQueue()
+	//pending messages are posted to the outbox by msgDispatcher before it exits
+	<-dispatched
+	close(stopSender)
+	<-sent
+	logMain.Infof("Stopped")
 }
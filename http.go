@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+)
+
+//HTTP configures the HTTP listener serving /metrics and /status
+type HTTP struct {
+	Listen string //e.g. "127.0.0.1:9150"
+	Token  string //required by /status as "Authorization: Bearer <Token>", /status is not served if empty
+}
+
+//startHTTP starts the HTTP listener, it is served until stopHTTP is called
+func (monitor *Monitor) startHTTP() (err error) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", monitor.serveMetrics)
+	if monitor.HTTP.Token != "" {
+		mux.HandleFunc("/status", monitor.serveStatus)
+	}
+	listener, err := net.Listen("tcp", monitor.HTTP.Listen)
+	if err != nil {
+		return
+	}
+	monitor.httpServer = &http.Server{Handler: mux, ReadTimeout: 10 * time.Second, WriteTimeout: 10 * time.Second}
+	go func() {
+		err := monitor.httpServer.Serve(listener)
+		if err != http.ErrServerClosed {
+			logMain.Errorf("HTTP listener stopped: %s", err)
+		}
+	}()
+	logMain.Infof("Listening on %s", listener.Addr())
+	return
+}
+
+func (monitor *Monitor) stopHTTP() {
+	if monitor.httpServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	monitor.httpServer.Shutdown(ctx)
+}
@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Lite server queries (lite_api.tl). Proofs returned by the server are not checked: it is the node's own lite server
+
+const (
+	tlLiteQuery          = 0x798c06df //liteServer.query data:bytes = Object
+	tlLiteError          = 0xbba9e148 //liteServer.error code:int message:string = liteServer.Error
+	tlGetMasterchainInfo = 0x89b5e62e //liteServer.getMasterchainInfo = liteServer.MasterchainInfo
+	tlMasterchainInfo    = 0x85832881 //liteServer.masterchainInfo last:tonNode.blockIdExt state_root_hash:int256 init:tonNode.zeroStateIdExt
+	tlGetConfigParams    = 0x2a111c19 //liteServer.getConfigParams mode:# id:tonNode.blockIdExt param_list:(vector int) = liteServer.ConfigInfo
+	tlConfigInfo         = 0xae7b272f //liteServer.configInfo mode:# id:tonNode.blockIdExt state_proof:bytes config_proof:bytes
+	tlRunSmcMethod       = 0x5cc65dd2 //liteServer.runSmcMethod mode:# id:tonNode.blockIdExt account:liteServer.accountId method_id:long params:bytes
+	tlRunMethodResult    = 0xa39a616b //liteServer.runMethodResult mode:# id shardblk shard_proof proof state_proof init_c7 lib_extras exit_code:int result
+	tlGetAccountState    = 0x6b890e25 //liteServer.getAccountState id:tonNode.blockIdExt account:liteServer.accountId = liteServer.AccountState
+	tlAccountState       = 0x7079c751 //liteServer.accountState id:tonNode.blockIdExt shardblk:tonNode.blockIdExt shard_proof:bytes proof:bytes state:bytes
+
+	liteServerAddr = "127.0.0.1:3031" //default Node LiteServerAddr
+	electorAddr    = "-1:3333333333333333333333333333333333333333333333333333333333333333"
+)
+
+//blockID is tonNode.blockIdExt
+type blockID struct {
+	Workchain int32
+	Shard     int64
+	Seqno     int32
+	RootHash  [32]byte
+	FileHash  [32]byte
+}
+
+func (id blockID) write(w *tlWriter) {
+	w.uint32(uint32(id.Workchain))
+	w.int64(id.Shard)
+	w.uint32(uint32(id.Seqno))
+	w.Write(id.RootHash[:])
+	w.Write(id.FileHash[:])
+}
+
+func readBlockID(r *tlReader) (id blockID) {
+	id.Workchain = r.int32()
+	id.Shard = r.int64()
+	id.Seqno = r.int32()
+	id.RootHash = r.int256()
+	id.FileHash = r.int256()
+	return
+}
+
+//accountID is liteServer.accountId, an address "workchain:hex"
+type accountID struct {
+	Workchain int32
+	ID        [32]byte
+}
+
+func parseAccountID(addr string) (account accountID, err error) {
+	parts := strings.SplitN(addr, ":", 2)
+	if len(parts) != 2 {
+		return account, fmt.Errorf("Invalid address %s", addr)
+	}
+	workchain, err := strconv.ParseInt(parts[0], 10, 32)
+	if err != nil {
+		return account, fmt.Errorf("Invalid address %s", addr)
+	}
+	id, err := hex.DecodeString(parts[1])
+	if err != nil || len(id) != 32 {
+		return account, fmt.Errorf("Invalid address %s", addr)
+	}
+	account.Workchain = int32(workchain)
+	copy(account.ID[:], id)
+	return
+}
+
+//validatorSet is ConfigParam 34 (current validators), 35 or 36 (next validators)
+type validatorSet struct {
+	Since      time.Time
+	Until      time.Time
+	Total      int
+	Main       int
+	Validators []validatorDescr
+}
+
+type validatorDescr struct {
+	PubKey [32]byte
+	Weight uint64
+	ADNL   [32]byte //zero if the validator has no ADNL address
+}
+
+//hasADNL tells if the ADNL address (hex, as printed by validator-engine-console) is in the set
+func (set *validatorSet) hasADNL(adnl string) bool {
+	for _, v := range set.Validators {
+		if strings.EqualFold(hex.EncodeToString(v.ADNL[:]), adnl) {
+			return true
+		}
+	}
+	return false
+}
+
+//electionParticipant is an entry of the elector's participant_list
+type electionParticipant struct {
+	PubKey *big.Int
+	Stake  *big.Int //nanotokens
+}
+
+//accountState is the state of an account in the last masterchain block
+type accountState struct {
+	Exists      bool
+	Status      string //"active", "uninit" or "frozen"
+	Balance     *big.Int
+	LastTransLt uint64
+}
+
+//liteClient is a connection to the node's lite server
+type liteClient struct {
+	*adnlConn
+}
+
+//dialLite connects to the node's lite server with the Node LiteServerKey
+func (n *cppNode) dialLite(ctx context.Context) (*liteClient, error) {
+	key, err := readPublicKey(n.keyFile(n.config.LiteServerKey))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialADNL(ctx, n.config.LiteServerAddr, key)
+	if err != nil {
+		return nil, err
+	}
+	return &liteClient{conn}, nil
+}
+
+//query sends a lite server query and returns a reader of the answer, checking its constructor
+func (c *liteClient) query(q []byte, answer uint32) (*tlReader, error) {
+	var w tlWriter
+	w.uint32(tlLiteQuery)
+	w.bytes(q)
+	data, err := c.adnlConn.query(w.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return liteAnswer(data, answer)
+}
+
+//liteAnswer returns a reader of a lite server answer, checking its constructor
+func liteAnswer(data []byte, answer uint32) (*tlReader, error) {
+	r := &tlReader{data: data}
+	switch id := r.uint32(); {
+	case r.err != nil:
+		return nil, r.err
+	case id == tlLiteError:
+		code := r.int32()
+		return nil, fmt.Errorf("Lite server error %d: %s", code, r.bytes())
+	case id != answer:
+		return nil, fmt.Errorf("Unexpected lite server answer %08x", id)
+	}
+	return r, nil
+}
+
+//masterchainInfo returns the last masterchain block
+func (c *liteClient) masterchainInfo() (last blockID, err error) {
+	var w tlWriter
+	w.uint32(tlGetMasterchainInfo)
+	r, err := c.query(w.Bytes(), tlMasterchainInfo)
+	if err != nil {
+		return
+	}
+	last = readBlockID(r)
+	return last, r.err
+}
+
+//configParam returns the cell of a configuration parameter in the state of the block, nil if the parameter is not set
+func (c *liteClient) configParam(block blockID, param int32) (*cellSlice, error) {
+	var w tlWriter
+	w.uint32(tlGetConfigParams)
+	w.uint32(0)
+	block.write(&w)
+	w.uint32(1)
+	w.uint32(uint32(param))
+	r, err := c.query(w.Bytes(), tlConfigInfo)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfigInfo(r, param)
+}
+
+//parseConfigInfo returns the cell of a configuration parameter in liteServer.configInfo, nil if the parameter is not set
+func parseConfigInfo(r *tlReader, param int32) (*cellSlice, error) {
+	r.uint32()
+	readBlockID(r)
+	r.bytes()
+	proof := r.bytes()
+	if r.err != nil {
+		return nil, r.err
+	}
+	roots, err := parseBoC(proof)
+	if err != nil {
+		return nil, err
+	}
+	if len(roots) != 1 {
+		return nil, fmt.Errorf("Invalid config proof")
+	}
+	//shard_state#9023afe2 ... ^OutMsgQueueInfo ^ShardAccounts ^[...] custom:(Maybe ^McStateExtra)
+	state := roots[0].slice()
+	if tag := state.uint(32); state.err == nil && tag != 0x9023afe2 {
+		return nil, fmt.Errorf("Invalid shard state tag %08x", tag)
+	}
+	state.loadRef()
+	state.loadRef()
+	state.loadRef()
+	//masterchain_state_extra#cc26 shard_hashes:ShardHashes config:ConfigParams ...
+	extra := state.loadRef()
+	if tag := extra.uint(16); extra.err == nil && tag != 0xcc26 {
+		return nil, fmt.Errorf("Invalid masterchain state tag %04x", tag)
+	}
+	if extra.bit() {
+		extra.loadRef()
+	}
+	//_ config_addr:bits256 config:^(Hashmap 32 ^Cell) = ConfigParams
+	extra.bytes(32)
+	config := extra.loadRef()
+	if config.err != nil {
+		return nil, config.err
+	}
+	value, err := dictGet(config, 32, uint64(param))
+	if err != nil || value == nil {
+		return nil, err
+	}
+	s := value.loadRef()
+	return s, s.err
+}
+
+//validatorSet returns the validator set of a configuration parameter (34, 35, 36), nil if it is not set
+func (c *liteClient) validatorSet(block blockID, param int32) (set *validatorSet, err error) {
+	s, err := c.configParam(block, param)
+	if err != nil || s == nil {
+		return
+	}
+	return parseValidatorSet(s)
+}
+
+//parseValidatorSet reads ValidatorSet
+func parseValidatorSet(s *cellSlice) (set *validatorSet, err error) {
+	set = &validatorSet{}
+	tag := s.uint(8)
+	set.Since = time.Unix(int64(s.uint(32)), 0)
+	set.Until = time.Unix(int64(s.uint(32)), 0)
+	set.Total = int(s.uint(16))
+	set.Main = int(s.uint(16))
+	list := s
+	switch tag {
+	case 0x11:
+		//validators#11 ... list:(Hashmap 16 ValidatorDescr)
+	case 0x12:
+		//validators_ext#12 ... total_weight:uint64 list:(HashmapE 16 ValidatorDescr)
+		s.uint(64)
+		if !s.bit() {
+			return set, s.err
+		}
+		list = s.loadRef()
+	default:
+		return nil, fmt.Errorf("Invalid validator set tag %02x", tag)
+	}
+	if s.err != nil {
+		return nil, s.err
+	}
+	err = dictEach(list, 16, func(_ uint64, v *cellSlice) error {
+		//validator#53 public_key:SigPubKey weight:uint64, validator_addr#73 ... adnl_addr:bits256
+		var descr validatorDescr
+		tag := v.uint(8)
+		if key := v.uint(32); v.err == nil && (tag != 0x53 && tag != 0x73 || key != 0x8e81278a) {
+			return fmt.Errorf("Invalid validator description")
+		}
+		copy(descr.PubKey[:], v.bytes(32))
+		descr.Weight = v.uint(64)
+		if tag == 0x73 {
+			copy(descr.ADNL[:], v.bytes(32))
+		}
+		set.Validators = append(set.Validators, descr)
+		return v.err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+//methodID is the ID of a get-method: crc16 of its name with bit 16 set
+func methodID(name string) int64 {
+	var crc uint16
+	for _, b := range []byte(name) {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return int64(crc) | 0x10000
+}
+
+//runMethod runs a get-method without arguments and returns its result stack, the bottom first.
+//Values are *big.Int, nil, *cell (cells, slices and builders) and []interface{} (tuples)
+func (c *liteClient) runMethod(block blockID, addr string, method string) (stack []interface{}, err error) {
+	account, err := parseAccountID(addr)
+	if err != nil {
+		return
+	}
+	var w tlWriter
+	w.uint32(tlRunSmcMethod)
+	w.uint32(4) //the result only, no proofs
+	block.write(&w)
+	w.uint32(uint32(account.Workchain))
+	w.Write(account.ID[:])
+	w.int64(methodID(method))
+	//vm_stack#_ depth:(## 24) stack:(VmStackList depth), empty
+	w.bytes(serializeBoC(&cell{data: make([]byte, 3), bits: 24}))
+	r, err := c.query(w.Bytes(), tlRunMethodResult)
+	if err != nil {
+		return
+	}
+	return parseRunMethodResult(r, addr, method)
+}
+
+//parseRunMethodResult returns the result stack in liteServer.runMethodResult, the bottom first
+func parseRunMethodResult(r *tlReader, addr string, method string) (stack []interface{}, err error) {
+	mode := r.uint32()
+	readBlockID(r)
+	readBlockID(r)
+	for _, flag := range []uint32{1, 1, 2, 8, 16} {
+		if mode&flag != 0 {
+			r.bytes()
+		}
+	}
+	exitCode := r.int32()
+	var result []byte
+	if mode&4 != 0 {
+		result = r.bytes()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if exitCode != 0 && exitCode != 1 {
+		return nil, fmt.Errorf("Method %s of %s failed, exit code %d", method, addr, exitCode)
+	}
+	roots, err := parseBoC(result)
+	if err != nil {
+		return
+	}
+	if len(roots) != 1 {
+		return nil, fmt.Errorf("Invalid result of %s", method)
+	}
+	s := roots[0].slice()
+	depth := int(s.uint(24))
+	stack, err = stackList(s, depth)
+	return
+}
+
+//stackList reads VmStackList n: vm_stk_cons#_ rest:^(VmStackList n) tos:VmStackValue
+func stackList(s *cellSlice, n int) (values []interface{}, err error) {
+	if n == 0 {
+		return nil, s.err
+	}
+	rest := s.loadRef()
+	values, err = stackList(rest, n-1)
+	if err != nil {
+		return
+	}
+	value, err := stackValue(s)
+	return append(values, value), err
+}
+
+//stackValue reads VmStackValue
+func stackValue(s *cellSlice) (value interface{}, err error) {
+	switch tag := s.uint(8); tag {
+	case 0x00:
+		//vm_stk_null#00
+	case 0x01:
+		//vm_stk_tinyint#01 value:int64
+		value = s.bigInt(64)
+	case 0x02:
+		//vm_stk_int#0201_ value:int257, vm_stk_nan#02ff
+		if s.uint(7) != 0 {
+			return nil, fmt.Errorf("NaN in the stack")
+		}
+		value = s.bigInt(257)
+	case 0x03, 0x04, 0x05:
+		//vm_stk_cell#03 cell:^Cell, vm_stk_slice#04 cell:^Cell st_bits:(## 10) end_bits:(## 10) st_ref:(#<= 4) end_ref:(#<= 4), vm_stk_builder#05 cell:^Cell
+		if s.err == nil && s.ref < len(s.c.refs) {
+			value = s.c.refs[s.ref]
+		}
+		s.loadRef()
+	case 0x07:
+		//vm_stk_tuple#07 len:(## 16) data:(VmTuple len)
+		value, err = stackTuple(s, int(s.uint(16)))
+	default:
+		return nil, fmt.Errorf("Unsupported stack value %02x", tag)
+	}
+	if err == nil {
+		err = s.err
+	}
+	return
+}
+
+//stackTuple reads VmTuple n: vm_tuple_tcons$_ head:(VmTupleRef (n - 1)) tail:^VmStackValue
+func stackTuple(s *cellSlice, n int) (tuple []interface{}, err error) {
+	if n == 0 {
+		return []interface{}{}, s.err
+	}
+	switch n - 1 {
+	case 0:
+	case 1:
+		//vm_tupref_single$_ entry:^VmStackValue
+		v, err := stackValue(s.loadRef())
+		if err != nil {
+			return nil, err
+		}
+		tuple = append(tuple, v)
+	default:
+		//vm_tupref_any$_ ref:^(VmTuple n)
+		tuple, err = stackTuple(s.loadRef(), n-1)
+		if err != nil {
+			return
+		}
+	}
+	tail, err := stackValue(s.loadRef())
+	return append(tuple, tail), err
+}
+
+//activeElectionID returns the elector's active_election_id, 0 if the elections are not open
+func (c *liteClient) activeElectionID(block blockID) (id *big.Int, err error) {
+	stack, err := c.runMethod(block, electorAddr, "active_election_id")
+	if err != nil {
+		return
+	}
+	if len(stack) != 1 {
+		return nil, fmt.Errorf("Unexpected result of active_election_id: %v", stack)
+	}
+	id, ok := stack[0].(*big.Int)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected result of active_election_id: %v", stack)
+	}
+	return
+}
+
+//participants returns the elector's participant_list
+func (c *liteClient) participants(block blockID) (list []electionParticipant, err error) {
+	stack, err := c.runMethod(block, electorAddr, "participant_list")
+	if err != nil {
+		return
+	}
+	return participantList(stack)
+}
+
+//accountState returns the state of the account in the block
+func (c *liteClient) accountState(block blockID, addr string) (state accountState, err error) {
+	account, err := parseAccountID(addr)
+	if err != nil {
+		return
+	}
+	var w tlWriter
+	w.uint32(tlGetAccountState)
+	block.write(&w)
+	w.uint32(uint32(account.Workchain))
+	w.Write(account.ID[:])
+	r, err := c.query(w.Bytes(), tlAccountState)
+	if err != nil {
+		return
+	}
+	return parseAccountState(r, addr)
+}
+
+//parseAccountState reads the state of the account in liteServer.accountState
+func parseAccountState(r *tlReader, addr string) (state accountState, err error) {
+	readBlockID(r)
+	readBlockID(r)
+	r.bytes()
+	r.bytes()
+	data := r.bytes()
+	if r.err != nil || len(data) == 0 {
+		return state, r.err
+	}
+	roots, err := parseBoC(data)
+	if err != nil {
+		return
+	}
+	if len(roots) != 1 {
+		return state, fmt.Errorf("Invalid state of %s", addr)
+	}
+	//account_none$0, account$1 addr:MsgAddressInt storage_stat:StorageInfo storage:AccountStorage
+	s := roots[0].slice()
+	if !s.bit() {
+		return state, s.err
+	}
+	state.Exists = true
+	//addr_std$10 anycast:(Maybe Anycast) workchain_id:int8 address:bits256, addr_var$11 ... addr_len:(## 9) workchain_id:int32
+	kind := s.uint(2)
+	if s.bit() {
+		s.uint(int(s.uint(5)))
+	}
+	switch kind {
+	case 2:
+		s.uint(8)
+		s.bytes(32)
+	case 3:
+		length := int(s.uint(9))
+		s.uint(32)
+		s.bytes(length / 8)
+		s.uint(length % 8)
+	default:
+		return state, fmt.Errorf("Invalid address in the state of %s", addr)
+	}
+	//storage_info$_ used:StorageUsed last_paid:uint32 due_payment:(Maybe Grams), StorageUsed is 3 VarUInteger 7
+	s.varUint(7)
+	s.varUint(7)
+	s.varUint(7)
+	s.uint(32)
+	if s.bit() {
+		s.varUint(16)
+	}
+	//account_storage$_ last_trans_lt:uint64 balance:CurrencyCollection state:AccountState
+	state.LastTransLt = s.uint(64)
+	state.Balance = s.varUint(16)
+	if s.bit() {
+		s.loadRef()
+	}
+	switch {
+	case s.bit():
+		state.Status = "active"
+	case s.bit():
+		state.Status = "frozen"
+	default:
+		state.Status = "uninit"
+	}
+	return state, s.err
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+//The answers in testdata were captured from a test lite server (built with tonutils-go) serving a masterchain state with
+//validator sets in ConfigParam 34 (and 36 in the -next files), an elector and its account
+
+//liteTestAnswer reads a captured answer and checks its constructor
+func liteTestAnswer(t *testing.T, name string, answer uint32) *tlReader {
+	t.Helper()
+	data, err := ioutil.ReadFile("testdata/" + name + ".hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := liteAnswer(raw, answer)
+	if err != nil {
+		t.Fatalf("%s: %s", name, err)
+	}
+	return r
+}
+
+func TestMasterchainInfo(t *testing.T) {
+	r := liteTestAnswer(t, "getMasterchainInfo", tlMasterchainInfo)
+	block := readBlockID(r)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if block.Workchain != -1 || block.Shard != -0x8000000000000000 || block.Seqno != 777 {
+		t.Errorf("block = %+v", block)
+	}
+}
+
+func TestLiteAnswerError(t *testing.T) {
+	raw, _ := hex.DecodeString("48e1a9bb94010000096e6f206d6574686f640000")
+	_, err := liteAnswer(raw, tlRunMethodResult)
+	if err == nil || err.Error() != "Lite server error 404: no method" {
+		t.Errorf("error = %v", err)
+	}
+	_, err = liteAnswer([]byte{0x81, 0x28, 0x83, 0x85}, tlConfigInfo)
+	if err == nil || !strings.HasPrefix(err.Error(), "Unexpected lite server answer 85832881") {
+		t.Errorf("error = %v", err)
+	}
+	_, err = liteAnswer([]byte{1, 2}, tlConfigInfo)
+	if err == nil {
+		t.Errorf("no error for a truncated answer")
+	}
+}
+
+func TestParseValidatorSet(t *testing.T) {
+	tests := []struct {
+		file  string
+		param int32
+		count int //0 - the parameter is not set
+		base  byte
+	}{
+		{"getConfigParams", 34, 3, 10},
+		{"getConfigParams", 36, 0, 0},
+		{"getConfigParams", 35, 0, 0},
+		{"getConfigParams-next", 34, 3, 10},
+		{"getConfigParams-next", 36, 2, 20},
+	}
+	for _, test := range tests {
+		r := liteTestAnswer(t, test.file, tlConfigInfo)
+		s, err := parseConfigInfo(r, test.param)
+		if err != nil {
+			t.Errorf("%s %d: %s", test.file, test.param, err)
+			continue
+		}
+		if test.count == 0 {
+			if s != nil {
+				t.Errorf("%s %d: the parameter is found", test.file, test.param)
+			}
+			continue
+		}
+		set, err := parseValidatorSet(s)
+		if err != nil {
+			t.Errorf("%s %d: %s", test.file, test.param, err)
+			continue
+		}
+		if !set.Since.Equal(time.Unix(1000, 0)) || !set.Until.Equal(time.Unix(2000, 0)) || set.Total != test.count || set.Main != test.count {
+			t.Errorf("%s %d: set = %+v", test.file, test.param, set)
+		}
+		if len(set.Validators) != test.count {
+			t.Errorf("%s %d: %d validators, want %d", test.file, test.param, len(set.Validators), test.count)
+			continue
+		}
+		for i, v := range set.Validators {
+			if v.PubKey[0] != test.base+byte(i) || v.Weight != uint64(100+i) || v.ADNL[0] != 0xab || v.ADNL[31] != test.base+byte(i) {
+				t.Errorf("%s %d: validator %d = %+v", test.file, test.param, i, v)
+			}
+		}
+		adnl := "ab" + strings.Repeat("00", 30) + hex.EncodeToString([]byte{test.base})
+		if !set.hasADNL(strings.ToUpper(adnl)) || set.hasADNL(strings.Repeat("00", 32)) {
+			t.Errorf("%s %d: hasADNL is wrong", test.file, test.param)
+		}
+	}
+}
+
+func TestParseRunMethodResult(t *testing.T) {
+	tests := []struct {
+		file   string
+		method string
+		want   string
+	}{
+		{"runSmcMethod-active_election_id", "active_election_id", "[0]"},
+		{"runSmcMethod-active_election_id-open", "active_election_id", "[1600000000]"},
+		{"runSmcMethod-participant_list", "participant_list", "[[[112233445566778899 123000000000] [[98765432109876543210987654321098765432109876543210 5000000000000] <nil>]]]"},
+	}
+	for _, test := range tests {
+		r := liteTestAnswer(t, test.file, tlRunMethodResult)
+		stack, err := parseRunMethodResult(r, electorAddr, test.method)
+		if err != nil {
+			t.Errorf("%s: %s", test.file, err)
+			continue
+		}
+		if got := stackString(stack); got != test.want {
+			t.Errorf("%s: stack = %s, want %s", test.file, got, test.want)
+		}
+	}
+	r := liteTestAnswer(t, "runSmcMethod-participant_list", tlRunMethodResult)
+	stack, err := parseRunMethodResult(r, electorAddr, "participant_list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := participantList(stack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].PubKey.String() != "112233445566778899" || list[1].Stake.Cmp(big.NewInt(5000000000000)) != 0 {
+		t.Errorf("participants = %v", list)
+	}
+}
+
+//stackString prints a stack with nested tuples
+func stackString(v interface{}) string {
+	switch v := v.(type) {
+	case []interface{}:
+		var values []string
+		for _, value := range v {
+			values = append(values, stackString(value))
+		}
+		return "[" + strings.Join(values, " ") + "]"
+	case *big.Int:
+		return v.String()
+	case nil:
+		return "<nil>"
+	}
+	return "?"
+}
+
+func TestParseAccountState(t *testing.T) {
+	r := liteTestAnswer(t, "getAccountState", tlAccountState)
+	state, err := parseAccountState(r, electorAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Exists || state.Status != "uninit" || state.LastTransLt != 555666777 || state.Balance.Cmp(big.NewInt(42123456789)) != 0 {
+		t.Errorf("state = %+v", state)
+	}
+}
+
+func TestMethodID(t *testing.T) {
+	tests := []struct {
+		name string
+		want int64
+	}{
+		{"participant_list", 123541},
+		{"active_election_id", 86535},
+		{"seqno", 85143},
+		{"get_public_key", 78748},
+	}
+	for _, test := range tests {
+		if got := methodID(test.name); got != test.want {
+			t.Errorf("methodID(%q) = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseAccountID(t *testing.T) {
+	tests := []struct {
+		addr string
+		ok   bool
+	}{
+		{electorAddr, true},
+		{"0:" + strings.Repeat("ab", 32), true},
+		{strings.Repeat("ab", 32), false},
+		{"-1:3333", false},
+		{"x:" + strings.Repeat("ab", 32), false},
+	}
+	for _, test := range tests {
+		account, err := parseAccountID(test.addr)
+		if (err == nil) != test.ok {
+			t.Errorf("parseAccountID(%q) error = %v", test.addr, err)
+		}
+		if err == nil && account.ID[0] != 0x33 && account.ID[0] != 0xab {
+			t.Errorf("parseAccountID(%q) = %+v", test.addr, account)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Level of ftvmon's own log messages
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+//parseLevel parses "debug", "info", "warn" or "error", "" means LevelInfo
+func parseLevel(s string) (Level, error) {
+	if s == "" {
+		return LevelInfo, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level %s, use one of %v", s, levelNames)
+}
+
+//subsystems which can have their own log level
+var subsystems = []string{"main", "checks", "logs", "telegram"}
+
+//Logging configures ftvmon's own log
+type Logging struct {
+	Level      string            //"debug", "info", "warn" or "error", "info" if empty
+	Subsystems map[string]string //level per subsystem: "main", "checks", "logs" or "telegram"
+	JSON       bool              //a JSON object per line instead of text
+	File       string            //"" - stderr
+	MaxSize    int               //MB, the file is rotated when it grows bigger, 10 if not set
+	MaxFiles   int               //rotated files kept, 3 if not set
+	level      Level
+	levels     map[string]Level
+}
+
+func (c *Logging) parse() (err error) {
+	c.level, err = parseLevel(c.Level)
+	if err != nil {
+		return
+	}
+	c.levels = make(map[string]Level)
+	for subsystem, l := range c.Subsystems {
+		if _, found := find(subsystems, subsystem); !found {
+			return fmt.Errorf("Unknown log subsystem %s, use one of %v", subsystem, subsystems)
+		}
+		c.levels[subsystem], err = parseLevel(l)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+//logger writes messages of a subsystem, with optional key-value fields
+type logger struct {
+	subsystem string
+	fields    []interface{}
+}
+
+var (
+	logMain     = &logger{subsystem: "main"}
+	logChecks   = &logger{subsystem: "checks"}
+	logLogs     = &logger{subsystem: "logs"}
+	logTelegram = &logger{subsystem: "telegram"}
+)
+
+//logMutex protects logOutput
+var logMutex sync.Mutex
+
+var logOutput = struct {
+	level  Level
+	levels map[string]Level
+	json   bool
+	out    io.Writer
+	file   *rotatingFile
+}{level: LevelInfo, out: os.Stderr}
+
+//setupLogging applies the config parsed by readConfig, it is called on start and on reload
+func setupLogging(c Logging) (err error) {
+	var file *rotatingFile
+	if c.File != "" {
+		file, err = openRotating(c.File, c.MaxSize, c.MaxFiles)
+		if err != nil {
+			return
+		}
+	}
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	if logOutput.file != nil {
+		logOutput.file.Close()
+	}
+	logOutput.level = c.level
+	logOutput.levels = c.levels
+	logOutput.json = c.JSON
+	logOutput.file = file
+	logOutput.out = os.Stderr
+	if file != nil {
+		logOutput.out = file
+	}
+	return
+}
+
+//With returns a logger adding the key-value pairs to every message
+func (l *logger) With(kv ...interface{}) *logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &logger{subsystem: l.subsystem, fields: fields}
+}
+
+func (l *logger) Debugf(format string, args ...interface{}) {
+	l.output(LevelDebug, format, args...)
+}
+
+func (l *logger) Infof(format string, args ...interface{}) {
+	l.output(LevelInfo, format, args...)
+}
+
+func (l *logger) Warnf(format string, args ...interface{}) {
+	l.output(LevelWarn, format, args...)
+}
+
+func (l *logger) Errorf(format string, args ...interface{}) {
+	l.output(LevelError, format, args...)
+}
+
+func (l *logger) output(level Level, format string, args ...interface{}) {
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	min, found := logOutput.levels[l.subsystem]
+	if !found {
+		min = logOutput.level
+	}
+	if level < min {
+		return
+	}
+	now := time.Now()
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	var line []byte
+	if logOutput.json {
+		entry := map[string]interface{}{
+			"time":      now.Format(time.RFC3339Nano),
+			"level":     level.String(),
+			"subsystem": l.subsystem,
+			"msg":       msg,
+		}
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			entry[fmt.Sprint(l.fields[i])] = l.fields[i+1]
+		}
+		line, _ = json.Marshal(entry)
+	} else {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s %-5s %s: %s", now.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), l.subsystem, msg)
+		for i := 0; i+1 < len(l.fields); i += 2 {
+			fmt.Fprintf(&b, " %v=%q", l.fields[i], fmt.Sprint(l.fields[i+1]))
+		}
+		line = []byte(b.String())
+	}
+	logOutput.out.Write(append(line, '\n'))
+}
+
+//rotatingFile is a log file which is renamed to file.1 (file.1 to file.2 and so on) when it grows over maxSize
+type rotatingFile struct {
+	name     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func openRotating(name string, maxSizeMB int, maxFiles int) (r *rotatingFile, err error) {
+	if maxSizeMB <= 0 {
+		maxSizeMB = 10
+	}
+	if maxFiles <= 0 {
+		maxFiles = 3
+	}
+	r = &rotatingFile{name: name, maxSize: int64(maxSizeMB) << 20, maxFiles: maxFiles}
+	err = r.open()
+	return
+}
+
+func (r *rotatingFile) open() (err error) {
+	r.f, err = os.OpenFile(r.name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening log file: %s", err)
+	}
+	info, err := r.f.Stat()
+	if err != nil {
+		return
+	}
+	r.size = info.Size()
+	return
+}
+
+func (r *rotatingFile) Write(p []byte) (n int, err error) {
+	if r.size+int64(len(p)) > r.maxSize && r.size > 0 {
+		r.rotate()
+	}
+	n, err = r.f.Write(p)
+	r.size += int64(n)
+	return
+}
+
+func (r *rotatingFile) rotate() {
+	r.f.Close()
+	for i := r.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+	}
+	os.Rename(r.name, r.name+".1")
+	err := r.open()
+	if err != nil {
+		//keep logging somewhere
+		r.f = os.Stderr
+		fmt.Fprintln(os.Stderr, err)
+	}
+}
+
+func (r *rotatingFile) Close() error {
+	if r.f == os.Stderr {
+		return nil
+	}
+	return r.f.Close()
+}
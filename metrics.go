@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//checkSample is a snapshot of a check for the exporters
+type checkSample struct {
+	name     string
+	category string
+	value    float64
+	updated  time.Time //of the last measurement, zero if not measured since start
+	severity Severity  //reported to subscribers
+	warning  *float64
+	critical float64
+	failing  bool
+	failure  string
+	ackedBy  string
+	muted    bool
+	enabled  bool
+	since    time.Time //of the alert
+	message  string    //the last alert sent
+	status   string    //reported by /status
+}
+
+//logEventSample is a snapshot of a log event for the exporters
+type logEventSample struct {
+	file      string
+	match     string
+	threshold int
+	minutes   int    //Window
+	matched   uint64 //lines matched since start
+	window    int    //events within Window
+	alert     bool
+	since     time.Time
+	ackedBy   string
+	enabled   bool
+}
+
+//samples takes a snapshot of all checks and log events, sorted by name
+func (monitor *Monitor) samples() (checks []checkSample, events []logEventSample) {
+	checksMutex.RLock()
+	for _, group := range []map[string]*Metric{monitor.Checks, monitor.ExtChecks} {
+		for name, metric := range group {
+			metric.Lock()
+			checks = append(checks, checkSample{
+				name:     name,
+				category: metric.category,
+				value:    metric.value,
+				updated:  metric.updated,
+				severity: metric.lastSeverity,
+				warning:  metric.Warning,
+				critical: metric.critical(),
+				failing:  metric.broken,
+				failure:  metric.failure,
+				ackedBy:  metric.ackedBy,
+				enabled:  metric.Enabled,
+				since:    metric.alertSince,
+				message:  metric.lastMessage,
+				status:   metric.msgStatus,
+			})
+			metric.Unlock()
+		}
+	}
+	for _, l := range monitor.Logfiles {
+		for k := range l.Events {
+			entry := &l.Events[k]
+			entry.Lock()
+			events = append(events, logEventSample{
+				file:      l.File,
+				match:     entry.Match,
+				threshold: entry.Threshold,
+				minutes:   entry.Window,
+				matched:   entry.matched,
+				window:    len(entry.events),
+				alert:     entry.lastState,
+				since:     entry.alertSince,
+				ackedBy:   entry.ackedBy,
+				enabled:   l.Enabled && entry.Enabled,
+			})
+			entry.Unlock()
+		}
+	}
+	checksMutex.RUnlock()
+	//muteMutex is not taken under checksMutex
+	for i := range checks {
+		checks[i].muted = monitor.muted(checks[i].name)
+	}
+	sort.Slice(checks, func(i, j int) bool { return checks[i].name < checks[j].name })
+	return
+}
+
+//promFamily is a metric family in the Prometheus text exposition format
+type promFamily struct {
+	name    string
+	help    string
+	kind    string //"gauge" or "counter"
+	samples []string
+}
+
+func (f *promFamily) add(value float64, labels ...string) {
+	var b strings.Builder
+	b.WriteString(f.name)
+	if len(labels) > 0 {
+		b.WriteString("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteString(",")
+			}
+			fmt.Fprintf(&b, "%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		b.WriteString("}")
+	}
+	b.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64))
+	f.samples = append(f.samples, b.String())
+}
+
+func (f *promFamily) write(w io.Writer) {
+	if len(f.samples) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+	for _, s := range f.samples {
+		fmt.Fprintln(w, s)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+//serveMetrics exposes check values and alert states as gauges and log event matches as counters
+func (monitor *Monitor) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	checks, events := monitor.samples()
+	value := &promFamily{name: "ftvmon_check_value", help: "Last value measured by the check.", kind: "gauge"}
+	updated := &promFamily{name: "ftvmon_check_last_update_timestamp_seconds", help: "Time of the last measurement of the check.", kind: "gauge"}
+	threshold := &promFamily{name: "ftvmon_check_threshold", help: "Alert threshold of the check.", kind: "gauge"}
+	severity := &promFamily{name: "ftvmon_check_severity", help: "Alert state reported to subscribers: 0 - OK, 1 - warning, 2 - critical.", kind: "gauge"}
+	failing := &promFamily{name: "ftvmon_check_failing", help: "1 if the check fails to take measurements.", kind: "gauge"}
+	acked := &promFamily{name: "ftvmon_check_acknowledged", help: "1 if the alert of the check is acknowledged.", kind: "gauge"}
+	muted := &promFamily{name: "ftvmon_check_muted", help: "1 if alerts of the check are muted.", kind: "gauge"}
+	for _, c := range checks {
+		if !c.enabled {
+			continue
+		}
+		labels := []string{"check", c.name, "category", c.category}
+		if !c.updated.IsZero() {
+			value.add(c.value, labels...)
+			updated.add(float64(c.updated.UnixNano())/1e9, labels...)
+		}
+		if c.warning != nil {
+			threshold.add(*c.warning, append(labels, "severity", "warning")...)
+		}
+		threshold.add(c.critical, append(labels, "severity", "critical")...)
+		severity.add(float64(c.severity), labels...)
+		failing.add(boolValue(c.failing), labels...)
+		acked.add(boolValue(c.ackedBy != ""), labels...)
+		muted.add(boolValue(c.muted), labels...)
+	}
+	matched := &promFamily{name: "ftvmon_log_event_matches_total", help: "Log lines matched by the event since start.", kind: "counter"}
+	window := &promFamily{name: "ftvmon_log_event_window_count", help: "Events within the window of the log event.", kind: "gauge"}
+	alert := &promFamily{name: "ftvmon_log_event_alert", help: "1 if the log event is over its threshold.", kind: "gauge"}
+	eventAcked := &promFamily{name: "ftvmon_log_event_acknowledged", help: "1 if the alert of the log event is acknowledged.", kind: "gauge"}
+	for _, e := range events {
+		if !e.enabled {
+			continue
+		}
+		labels := []string{"file", e.file, "match", e.match}
+		matched.add(float64(e.matched), labels...)
+		window.add(float64(e.window), labels...)
+		alert.add(boolValue(e.alert), labels...)
+		eventAcked.add(boolValue(e.ackedBy != ""), labels...)
+	}
+	logsMuted := &promFamily{name: "ftvmon_log_events_muted", help: "1 if alerts of log events are muted.", kind: "gauge"}
+	logsMuted.add(boolValue(monitor.muted(logsCheck)))
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, f := range []*promFamily{value, updated, threshold, severity, failing, acked, muted, matched, window, alert, eventAcked, logsMuted} {
+		f.write(w)
+	}
+}
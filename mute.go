@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//allChecks mutes every check and log event
+const allChecks = "all"
+
+//muteMutex protects mutes and Maintenance
+var muteMutex sync.Mutex
+
+//Maintenance is a scheduled window, alerts of Checks (all if empty) are not sent during it
+type Maintenance struct {
+	Start  string //RFC3339, e.g. "2020-06-01T02:00:00Z"
+	End    string
+	Checks []string
+	start  time.Time
+	end    time.Time
+}
+
+//mute suppresses delivery of alerts until a deadline, the state of the checks is still tracked
+type mute struct {
+	until      time.Time
+	reason     string
+	suppressed []Alert
+}
+
+func (m *Maintenance) parse() (err error) {
+	m.start, err = time.Parse(time.RFC3339, m.Start)
+	if err != nil {
+		return fmt.Errorf("Invalid maintenance Start %q: %s", m.Start, err)
+	}
+	m.end, err = time.Parse(time.RFC3339, m.End)
+	if err != nil {
+		return fmt.Errorf("Invalid maintenance End %q: %s", m.End, err)
+	}
+	if !m.end.After(m.start) {
+		return fmt.Errorf("Maintenance End %s is not after Start %s", m.End, m.Start)
+	}
+	return
+}
+
+//muteTarget returns the canonical name of a check, allChecks or logsCheck
+func (monitor *Monitor) muteTarget(name string) (target string, err error) {
+	if strings.EqualFold(name, allChecks) {
+		return allChecks, nil
+	}
+	if strings.EqualFold(name, logsCheck) {
+		return logsCheck, nil
+	}
+	if monitor.Server != nil && strings.EqualFold(name, agentCheck) {
+		return agentCheck, nil
+	}
+	//checks of the agents are muted on all of them
+	for _, n := range monitor.agentChecks() {
+		if strings.EqualFold(n, name) {
+			return n, nil
+		}
+	}
+	checksMutex.RLock()
+	defer checksMutex.RUnlock()
+	for _, checks := range []map[string]*Metric{monitor.Checks, monitor.ExtChecks} {
+		for n := range checks {
+			if strings.EqualFold(n, name) {
+				return n, nil
+			}
+		}
+	}
+	err = fmt.Errorf("Unknown check %s, use a check name, %s or %s", name, logsCheck, allChecks)
+	return
+}
+
+//mute suppresses alerts of the target until the deadline, an existing mute is extended
+func (monitor *Monitor) mute(target string, until time.Time, reason string) {
+	muteMutex.Lock()
+	defer muteMutex.Unlock()
+	if m, found := monitor.mutes[target]; found {
+		if until.After(m.until) {
+			m.until = until
+			m.reason = reason
+		}
+		return
+	}
+	monitor.mutes[target] = &mute{until: until, reason: reason}
+}
+
+//unmute removes the mute of the target (all the mutes if target is ""), returns summaries of suppressed alerts
+func (monitor *Monitor) unmute(target string) (summaries []Alert) {
+	muteMutex.Lock()
+	defer muteMutex.Unlock()
+	for t, m := range monitor.mutes {
+		if target == "" || t == target {
+			summaries = append(summaries, m.summary(t))
+			delete(monitor.mutes, t)
+		}
+	}
+	return
+}
+
+//activeMute returns the mute of the check, nil if it is not muted, muteMutex has to be locked
+func (monitor *Monitor) activeMute(check string) *mute {
+	if check == "" {
+		return nil
+	}
+	now := time.Now()
+	for _, target := range []string{check, allChecks} {
+		if m, found := monitor.mutes[target]; found && now.Before(m.until) {
+			return m
+		}
+	}
+	return nil
+}
+
+//muted returns true if alerts of the check are not delivered
+func (monitor *Monitor) muted(check string) bool {
+	muteMutex.Lock()
+	defer muteMutex.Unlock()
+	return monitor.activeMute(check) != nil
+}
+
+//suppress returns true and records the alert if its check is muted
+func (monitor *Monitor) suppress(alert Alert) bool {
+	muteMutex.Lock()
+	defer muteMutex.Unlock()
+	m := monitor.activeMute(alert.Check)
+	if m == nil {
+		return false
+	}
+	m.suppressed = append(m.suppressed, alert)
+	return true
+}
+
+//updateMutes starts maintenance windows and removes expired mutes, returns summaries of expired ones
+func (monitor *Monitor) updateMutes(now time.Time) (summaries []Alert) {
+	muteMutex.Lock()
+	for _, m := range monitor.Maintenance {
+		if now.Before(m.start) || !now.Before(m.end) {
+			continue
+		}
+		targets := m.Checks
+		if len(targets) == 0 {
+			targets = []string{allChecks}
+		}
+		for _, target := range targets {
+			if mt, found := monitor.mutes[target]; !found || mt.until.Before(m.end) {
+				monitor.mutes[target] = &mute{until: m.end, reason: "maintenance"}
+				if found {
+					monitor.mutes[target].suppressed = mt.suppressed
+				}
+			}
+		}
+	}
+	for target, m := range monitor.mutes {
+		if !now.Before(m.until) {
+			summaries = append(summaries, m.summary(target))
+			delete(monitor.mutes, target)
+		}
+	}
+	muteMutex.Unlock()
+	return
+}
+
+//listMutes describes active mutes for /mute
+func (monitor *Monitor) listMutes() string {
+	muteMutex.Lock()
+	defer muteMutex.Unlock()
+	if len(monitor.mutes) == 0 {
+		return "Nothing is muted"
+	}
+	var lines []string
+	for target, m := range monitor.mutes {
+		lines = append(lines, fmt.Sprintf("%s muted (%s) until %s, %d alerts suppressed", target, m.reason, m.until.Format(time.RFC3339), len(m.suppressed)))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+//summary lists the last suppressed alert of every check
+func (m *mute) summary(target string) Alert {
+	alert := Alert{Category: "MUTE", Text: fmt.Sprintf("Mute of %s ended, no alerts suppressed", target)}
+	if len(m.suppressed) == 0 {
+		return alert
+	}
+	var order []string
+	last := make(map[string]Alert)
+	for _, a := range m.suppressed {
+		if _, found := last[a.Check]; !found {
+			order = append(order, a.Check)
+		}
+		last[a.Check] = a
+	}
+	lines := []string{fmt.Sprintf("Mute of %s ended, %d alerts suppressed, the last ones:", target, len(m.suppressed))}
+	for _, check := range order {
+		lines = append(lines, last[check].String())
+	}
+	alert.Text = strings.Join(lines, "\n")
+	return alert
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+//Node selects the node ExtChecks query: the C++ node (the default) or the Rust node (ton-labs-node)
+type Node struct {
+	Type           string            //"cpp" or "rust"
+	ConsoleAddr    string            //C++ node: the validator engine control interface, 127.0.0.1:3030 if not set
+	LiteServerAddr string            //C++ node: the lite server, 127.0.0.1:3031 if not set
+	ClientKey      string            //C++ node: the console's private key, in KeysPath if relative, client if not set
+	ServerKey      string            //C++ node: the control interface's public key, in KeysPath if relative, server.pub if not set
+	LiteServerKey  string            //C++ node: the lite server's public key, in KeysPath if relative, liteserver.pub if not set
+	Console        string            //Rust node: the console binary
+	ConsoleConfig  string            //Rust node: console.json of the console
+	TonosCLI       string            //Rust node: the tonos-cli binary
+	TonosDir       string            //Rust node: the directory with tonos-cli.conf.json, tonos-cli is run in it
+	Config         string            //Rust node: config.json of the node, with the validator keys
+	PS             string            //the ps binary of the Process check, ps in PATH if not set
+	Timeout        string            //Go duration, a node query or a command is stopped after it, 30s if not set
+	Timeouts       map[string]string //Go durations overriding Timeout by command: getstats, getconfig, runget, ps
+	timeout        time.Duration
+	timeouts       map[string]time.Duration
+}
+
+//nodeCommands are the commands with their own timeouts
+var nodeCommands = []string{"getstats", "getconfig", "runget", "ps"}
+
+//errQueryTimeout is returned when a node query or a command takes longer than its timeout
+var errQueryTimeout = errors.New("query timed out")
+
+func (n *Node) parse() (err error) {
+	switch n.Type {
+	case "", "cpp":
+	case "rust":
+		if n.Console == "" || n.ConsoleConfig == "" || n.TonosCLI == "" || n.Config == "" {
+			return fmt.Errorf("Node Console, ConsoleConfig, TonosCLI and Config are required for the Rust node")
+		}
+	default:
+		return fmt.Errorf("Invalid Node Type %q, should be cpp or rust", n.Type)
+	}
+	for _, path := range []*string{&n.ClientKey, &n.ServerKey, &n.LiteServerKey, &n.Console, &n.ConsoleConfig, &n.TonosCLI, &n.TonosDir, &n.Config, &n.PS} {
+		if *path != "" {
+			*path = filepath.Clean(*path)
+		}
+	}
+	setDefault := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	setDefault(&n.ConsoleAddr, consoleAddr)
+	setDefault(&n.LiteServerAddr, liteServerAddr)
+	setDefault(&n.ClientKey, "client")
+	setDefault(&n.ServerKey, "server.pub")
+	setDefault(&n.LiteServerKey, "liteserver.pub")
+	setDefault(&n.PS, "ps")
+	n.timeout = 30 * time.Second
+	if n.Timeout != "" {
+		n.timeout, err = time.ParseDuration(n.Timeout)
+		if err != nil || n.timeout <= 0 {
+			return fmt.Errorf("Invalid Node Timeout %q", n.Timeout)
+		}
+	}
+	n.timeouts = make(map[string]time.Duration)
+	for command, value := range n.Timeouts {
+		found := false
+		for _, c := range nodeCommands {
+			found = found || c == command
+		}
+		if !found {
+			return fmt.Errorf("Unknown command %q in Node Timeouts, should be one of %s", command, strings.Join(nodeCommands, ", "))
+		}
+		n.timeouts[command], err = time.ParseDuration(value)
+		if err != nil || n.timeouts[command] <= 0 {
+			return fmt.Errorf("Invalid Node Timeouts %s %q", command, value)
+		}
+	}
+	return
+}
+
+//keyFile returns the path of a key file, relative ones are in KeysPath
+func (n *cppNode) keyFile(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(n.keysPath, name)
+}
+
+//withTimeout runs f with the timeout of the command, errQueryTimeout is returned if it is reached
+func (n *Node) withTimeout(ctx context.Context, command string, f func(ctx context.Context) error) error {
+	timeout, found := n.timeouts[command]
+	if !found {
+		timeout = n.timeout
+	}
+	deadline := time.Now().Add(timeout)
+	queryCtx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	err := f(queryCtx)
+	//the error of a timed out query may be anything: a killed process, a closed connection...
+	if err != nil && ctx.Err() == nil && !time.Now().Before(deadline) {
+		logChecks.Warnf("%s timed out after %s: %s", command, timeout, err)
+		return errQueryTimeout
+	}
+	return err
+}
+
+//run runs a command and returns its output, the command and its children are killed when the timeout of the command is reached
+func (n *Node) run(ctx context.Context, command string, dir string, name string, args ...string) (out []byte, err error) {
+	err = n.withTimeout(ctx, command, func(ctx context.Context) error {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.Command(name, args...)
+		cmd.Dir = dir
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		cmd.Stdin = strings.NewReader("")
+		//the command runs in its own process group to kill its children too
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		err := cmd.Start()
+		if err == nil {
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+				case <-done:
+				}
+			}()
+			err = cmd.Wait()
+			close(done)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s %s", name, err, strings.TrimSpace(stderr.String()))
+		}
+		out = stdout.Bytes()
+		return nil
+	})
+	return
+}
+
+//nodeBackend is the node as seen by the ExtChecks
+type nodeBackend interface {
+	//stats returns the sync status of the node
+	stats(ctx context.Context) (validatorStats, error)
+	//validatorSet returns ConfigParam param (34 for the current validators, 36 for the next ones) in the last masterchain block, nil if it is not set
+	validatorSet(ctx context.Context, param int32) (*validatorSet, error)
+	//activeElectionID returns the elector's active_election_id, 0 if the elections are not open
+	activeElectionID(ctx context.Context) (*big.Int, error)
+	//participants returns the elector's participant list
+	participants(ctx context.Context) ([]electionParticipant, error)
+	//electionADNL returns the ADNL address (hex) of the validator for the last elections
+	electionADNL() (string, error)
+	//electionKeyID returns the key ID of the validator's public key in the last elections, nil if it has not taken part yet
+	electionKeyID() ([]byte, error)
+	//processes returns the threads of all processes, the output of Node PS -eLf
+	processes(ctx context.Context) ([]byte, error)
+}
+
+//node returns the backend of the configured node, with the config at the time of the call: reload replaces it
+func (monitor *Monitor) node() nodeBackend {
+	checksMutex.RLock()
+	config, keysPath := monitor.Node, monitor.KeysPath
+	checksMutex.RUnlock()
+	if config.Type == "rust" {
+		return &rustNode{config}
+	}
+	return &cppNode{config, keysPath, monitor.hostname}
+}
+
+//pubKeyID returns the key ID of a public key from the elector
+func pubKeyID(pubKey *big.Int) []byte {
+	if pubKey.Sign() < 0 || pubKey.BitLen() > 256 {
+		return nil
+	}
+	key := make([]byte, 32)
+	b := pubKey.Bytes()
+	copy(key[32-len(b):], b)
+	return keyID(ed25519.PublicKey(key))
+}
+
+//participantList converts participant_list: a list of [pubkey stake] pairs, [head tail], the last tail is null
+func participantList(result []interface{}) (list []electionParticipant, err error) {
+	if len(result) != 1 {
+		return nil, fmt.Errorf("Unexpected result of participant_list")
+	}
+	for l := result[0]; l != nil; {
+		cons, ok := l.([]interface{})
+		if !ok || len(cons) != 2 {
+			return nil, fmt.Errorf("Unexpected result of participant_list")
+		}
+		pair, ok := cons[0].([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("Unexpected result of participant_list")
+		}
+		pubKey, ok1 := pair[0].(*big.Int)
+		stake, ok2 := pair[1].(*big.Int)
+		if !ok1 || !ok2 {
+			return nil, fmt.Errorf("Unexpected result of participant_list")
+		}
+		list = append(list, electionParticipant{PubKey: pubKey, Stake: stake})
+		l = cons[1]
+	}
+	return
+}
+
+//cppNode queries the C++ node over ADNL, election keys are read from the files written by the election scripts
+type cppNode struct {
+	config   *Node
+	keysPath string
+	hostname string
+}
+
+func (n *cppNode) stats(ctx context.Context) (stats validatorStats, err error) {
+	err = n.config.withTimeout(ctx, "getstats", func(ctx context.Context) error {
+		console, err := n.dialConsole(ctx)
+		if err != nil {
+			return err
+		}
+		defer console.Close()
+		stats, err = console.stats()
+		return err
+	})
+	return
+}
+
+//lite connects to the lite server and calls f with the last masterchain block
+func (n *cppNode) lite(ctx context.Context, command string, f func(lite *liteClient, block blockID) error) error {
+	return n.config.withTimeout(ctx, command, func(ctx context.Context) error {
+		lite, err := n.dialLite(ctx)
+		if err != nil {
+			return err
+		}
+		defer lite.Close()
+		block, err := lite.masterchainInfo()
+		if err != nil {
+			return err
+		}
+		return f(lite, block)
+	})
+}
+
+func (n *cppNode) validatorSet(ctx context.Context, param int32) (set *validatorSet, err error) {
+	err = n.lite(ctx, "getconfig", func(lite *liteClient, block blockID) (err error) {
+		set, err = lite.validatorSet(block, param)
+		return
+	})
+	return
+}
+
+func (n *cppNode) activeElectionID(ctx context.Context) (id *big.Int, err error) {
+	err = n.lite(ctx, "runget", func(lite *liteClient, block blockID) (err error) {
+		id, err = lite.activeElectionID(block)
+		return
+	})
+	return
+}
+
+func (n *cppNode) participants(ctx context.Context) (participants []electionParticipant, err error) {
+	err = n.lite(ctx, "runget", func(lite *liteClient, block blockID) (err error) {
+		participants, err = lite.participants(block)
+		return
+	})
+	return
+}
+
+func (n *cppNode) processes(ctx context.Context) ([]byte, error) {
+	return n.config.run(ctx, "ps", "", n.config.PS, "-eLf")
+}
+
+//electionADNL reads the current ADNL address from the key file written by the election scripts
+func (n *cppNode) electionADNL() (adnlAddr string, err error) {
+	filename := n.keysPath + "/elections/" + n.hostname + "-election-adnl-key"
+	sFile, err := os.Open(filename)
+	if err != nil {
+		err = fmt.Errorf("Can't read %s, please check KeysPath", filename)
+		return
+	}
+	defer sFile.Close()
+	fileScanner := bufio.NewScanner(sFile)
+	fileScanner.Split(bufio.ScanLines)
+	for fileScanner.Scan() {
+		s := fileScanner.Text()
+		if strings.Contains(s, "created new key") {
+			words := strings.Fields(s)
+			adnlAddr = words[3]
+		}
+	}
+	return
+}
+
+//electionKeyID reads the public key the election request was signed with from the request dump
+func (n *cppNode) electionKeyID() (id []byte, err error) {
+	filename := n.keysPath + "/elections/" + n.hostname + "-request-dump2"
+	sFile, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Can't read %s, please check KeysPath", filename)
+	}
+	defer sFile.Close()
+	var pubKey string
+	fileScanner := bufio.NewScanner(sFile)
+	fileScanner.Split(bufio.ScanLines)
+	for fileScanner.Scan() {
+		s := fileScanner.Text()
+		if strings.Contains(s, "Provided a valid Ed25519 signature") {
+			words := strings.Fields(s)
+			pubKey = words[10]
+		}
+	}
+	pubKeyBig, ok := new(big.Int).SetString(pubKey, 16)
+	if !ok {
+		//no election request yet
+		return nil, nil
+	}
+	return pubKeyID(pubKeyBig), nil
+}
+
+//rustNode runs the console and tonos-cli of the Rust node and reads the validator keys from the node's config.json
+type rustNode struct {
+	config *Node
+}
+
+//jsonOutput returns the JSON object or array printed by a tool after its log lines
+func jsonOutput(out []byte) []byte {
+	if i := bytes.LastIndex(out, []byte("Result:")); i >= 0 {
+		out = out[i+len("Result:"):]
+	}
+	if i := bytes.IndexAny(out, "{["); i >= 0 {
+		return out[i:]
+	}
+	return nil
+}
+
+func (n *rustNode) processes(ctx context.Context) ([]byte, error) {
+	return n.config.run(ctx, "ps", "", n.config.PS, "-eLf")
+}
+
+//rustStats is the output of the console's getstats
+type rustStats struct {
+	SyncStatus           string `json:"sync_status"`
+	MasterchainBlockTime int64  `json:"masterchainblocktime"`
+	TimeDiff             int64  `json:"timediff"`
+}
+
+func (n *rustNode) stats(ctx context.Context) (stats validatorStats, err error) {
+	out, err := n.config.run(ctx, "getstats", "", n.config.Console, "-C", n.config.ConsoleConfig, "-c", "getstats")
+	if err != nil {
+		return
+	}
+	data := jsonOutput(out)
+	var rust rustStats
+	var values map[string]interface{}
+	if err = json.Unmarshal(data, &rust); err == nil {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&values)
+	}
+	if err != nil {
+		return stats, fmt.Errorf("Invalid getstats output: %s", err)
+	}
+	if rust.MasterchainBlockTime == 0 {
+		return stats, fmt.Errorf("No masterchainblocktime in getstats, sync status %q", rust.SyncStatus)
+	}
+	//timediff is how far the node is behind, TIME_DIFF of the C++ node is negative
+	stats.MasterchainBlockTime = rust.MasterchainBlockTime
+	stats.UnixTime = rust.MasterchainBlockTime + rust.TimeDiff
+	stats.Values = make(map[string]string)
+	for key, v := range values {
+		stats.Values[key] = fmt.Sprint(v)
+	}
+	return
+}
+
+//rustValidatorSet is ConfigParam 34 or 36 printed by tonos-cli getconfig
+type rustValidatorSet struct {
+	UtimeSince int64 `json:"utime_since"`
+	UtimeUntil int64 `json:"utime_until"`
+	Total      int   `json:"total"`
+	Main       int   `json:"main"`
+	List       []struct {
+		PublicKey string      `json:"public_key"`
+		Weight    interface{} `json:"weight"` //a number or a hex string
+		ADNLAddr  string      `json:"adnl_addr"`
+	} `json:"list"`
+}
+
+func (n *rustNode) validatorSet(ctx context.Context, param int32) (set *validatorSet, err error) {
+	out, err := n.config.run(ctx, "getconfig", n.config.TonosDir, n.config.TonosCLI, "-j", "getconfig", strconv.Itoa(int(param)))
+	if err != nil {
+		return
+	}
+	data := jsonOutput(out)
+	if data == nil || bytes.Equal(bytes.TrimSpace(data), []byte("{}")) {
+		return nil, nil
+	}
+	var rust rustValidatorSet
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err = decoder.Decode(&rust)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid getconfig %d output: %s", param, err)
+	}
+	if len(rust.List) == 0 {
+		return nil, nil
+	}
+	set = &validatorSet{Since: time.Unix(rust.UtimeSince, 0), Until: time.Unix(rust.UtimeUntil, 0), Total: rust.Total, Main: rust.Main}
+	for _, v := range rust.List {
+		var descr validatorDescr
+		pubKey, err1 := hex.DecodeString(v.PublicKey)
+		adnl, err2 := hex.DecodeString(v.ADNLAddr)
+		weight, _ := tonosValue(v.Weight)
+		weightBig, ok := weight.(*big.Int)
+		if err1 != nil || err2 != nil || !ok {
+			return nil, fmt.Errorf("Invalid getconfig %d output", param)
+		}
+		copy(descr.PubKey[:], pubKey)
+		copy(descr.ADNL[:], adnl)
+		descr.Weight = weightBig.Uint64()
+		set.Validators = append(set.Validators, descr)
+	}
+	return
+}
+
+//runGet runs a get-method of the elector with tonos-cli, numbers are converted to *big.Int, lists to []interface{}
+func (n *rustNode) runGet(ctx context.Context, method string) (result []interface{}, err error) {
+	out, err := n.config.run(ctx, "runget", n.config.TonosDir, n.config.TonosCLI, "-j", "runget", electorAddr, method)
+	if err != nil {
+		return
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(jsonOutput(out)))
+	decoder.UseNumber()
+	err = decoder.Decode(&value)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid runget %s output: %s", method, err)
+	}
+	//the values are either a list or an object of "value0", "value1"...
+	if object, ok := value.(map[string]interface{}); ok {
+		var keys []string
+		for key := range object {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		value = []interface{}{}
+		for _, key := range keys {
+			value = append(value.([]interface{}), object[key])
+		}
+	}
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid runget %s output", method)
+	}
+	converted, err := tonosValue(list)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid runget %s output: %s", method, err)
+	}
+	return converted.([]interface{}), nil
+}
+
+//tonosValue converts a stack value printed by tonos-cli
+func tonosValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case nil:
+		return nil, nil
+	case json.Number:
+		return tonosValue(string(v))
+	case string:
+		i, ok := new(big.Int).SetString(v, 0)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a number", v)
+		}
+		return i, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i := range v {
+			value, err := tonosValue(v[i])
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("Unsupported value %v", v)
+}
+
+func (n *rustNode) activeElectionID(ctx context.Context) (*big.Int, error) {
+	result, err := n.runGet(ctx, "active_election_id")
+	if err != nil {
+		return nil, err
+	}
+	if len(result) != 1 {
+		return nil, fmt.Errorf("Unexpected result of active_election_id: %v", result)
+	}
+	id, ok := result[0].(*big.Int)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected result of active_election_id: %v", result)
+	}
+	return id, nil
+}
+
+func (n *rustNode) participants(ctx context.Context) ([]electionParticipant, error) {
+	result, err := n.runGet(ctx, "participant_list")
+	if err != nil {
+		return nil, err
+	}
+	return participantList(result)
+}
+
+//rustValidatorKeys is the part of the node's config.json with the validator keys of the elections
+type rustValidatorKeys struct {
+	ValidatorKeys []struct {
+		ElectionID         int64  `json:"election_id"`
+		ValidatorKeyID     string `json:"validator_key_id"`
+		ValidatorADNLKeyID string `json:"validator_adnl_key_id"`
+	} `json:"validator_keys"`
+}
+
+//lastKeys returns the key IDs of the last elections in the node's config.json
+func (n *rustNode) lastKeys() (keyID []byte, adnlID []byte, err error) {
+	data, err := ioutil.ReadFile(n.config.Config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Can't read %s, please check Node Config", n.config.Config)
+	}
+	var config rustValidatorKeys
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error decoding %s: %s", n.config.Config, err)
+	}
+	if len(config.ValidatorKeys) == 0 {
+		return nil, nil, fmt.Errorf("No validator keys in %s", n.config.Config)
+	}
+	last := config.ValidatorKeys[0]
+	for _, keys := range config.ValidatorKeys {
+		if keys.ElectionID > last.ElectionID {
+			last = keys
+		}
+	}
+	keyID, err1 := base64.StdEncoding.DecodeString(last.ValidatorKeyID)
+	adnlID, err2 := base64.StdEncoding.DecodeString(last.ValidatorADNLKeyID)
+	if err1 != nil || err2 != nil {
+		return nil, nil, fmt.Errorf("Invalid validator keys in %s", n.config.Config)
+	}
+	return
+}
+
+func (n *rustNode) electionADNL() (string, error) {
+	_, adnlID, err := n.lastKeys()
+	if err != nil {
+		return "", err
+	}
+	return strings.ToUpper(hex.EncodeToString(adnlID)), nil
+}
+
+func (n *rustNode) electionKeyID() ([]byte, error) {
+	keyID, _, err := n.lastKeys()
+	return keyID, err
+}
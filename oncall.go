@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//onCallUser in escalation tier Users stands for the user on duty
+const onCallUser = "oncall"
+
+//onCallEscalation is used if OnCall is configured without Escalation: the user on duty first, then everyone
+const onCallEscalation = 15 * time.Minute
+
+//localLayout is the time format of OnCall, in its TimeZone
+const localLayout = "2006-01-02 15:04"
+
+//onCallMutex protects OnCall and handovers
+var onCallMutex sync.Mutex
+
+//OnCall is a weekly rotation of users, Rotation[0] is on duty for a week from Start, then Rotation[1] and so on
+type OnCall struct {
+	Rotation  []string
+	Start     string //"2006-01-02 15:04" in TimeZone, or RFC3339
+	TimeZone  string //IANA name, e.g. "Europe/Moscow", UTC if empty
+	Overrides []*Override
+	location  *time.Location
+	start     time.Time
+}
+
+//Override puts User on duty from Start to End, instead of the rotation
+type Override struct {
+	User  string
+	Start string //"2006-01-02 15:04" in TimeZone, or RFC3339
+	End   string
+	start time.Time
+	end   time.Time
+}
+
+//parseLocal parses RFC3339 or localLayout in the location
+func parseLocal(s string, location *time.Location) (t time.Time, err error) {
+	t, err = time.Parse(time.RFC3339, s)
+	if err == nil {
+		return
+	}
+	t, err = time.ParseInLocation(localLayout, s, location)
+	if err != nil {
+		err = fmt.Errorf("Invalid time %q, use %q or RFC3339", s, localLayout)
+	}
+	return
+}
+
+func (o *Override) parse(location *time.Location) (err error) {
+	o.start, err = parseLocal(o.Start, location)
+	if err != nil {
+		return
+	}
+	o.end, err = parseLocal(o.End, location)
+	if err != nil {
+		return
+	}
+	if !o.end.After(o.start) {
+		err = fmt.Errorf("Override End %s is not after Start %s", o.End, o.Start)
+	}
+	return
+}
+
+func (o *Override) covers(now time.Time) bool {
+	return !now.Before(o.start) && now.Before(o.end)
+}
+
+func (oc *OnCall) parse() (err error) {
+	if len(oc.Rotation) == 0 {
+		return fmt.Errorf("OnCall Rotation is empty")
+	}
+	oc.location, err = time.LoadLocation(oc.TimeZone)
+	if err != nil {
+		return fmt.Errorf("Invalid OnCall TimeZone %q: %s", oc.TimeZone, err)
+	}
+	oc.start, err = parseLocal(oc.Start, oc.location)
+	if err != nil {
+		return fmt.Errorf("Invalid OnCall Start: %s", err)
+	}
+	oc.start = oc.start.In(oc.location)
+	for _, o := range oc.Overrides {
+		err = o.parse(oc.location)
+		if err != nil {
+			return fmt.Errorf("Invalid OnCall override: %s", err)
+		}
+	}
+	return
+}
+
+//shift returns the rotation shift at now, shifts start at the same local time every week
+func (oc *OnCall) shift(now time.Time) (user string, start time.Time, end time.Time) {
+	weeks := int(now.Sub(oc.start).Hours() / (7 * 24))
+	start = oc.start.AddDate(0, 0, 7*weeks)
+	//a DST change can shift the estimate by an hour
+	for start.After(now) {
+		weeks--
+		start = oc.start.AddDate(0, 0, 7*weeks)
+	}
+	for !oc.start.AddDate(0, 0, 7*(weeks+1)).After(now) {
+		weeks++
+		start = oc.start.AddDate(0, 0, 7*weeks)
+	}
+	end = oc.start.AddDate(0, 0, 7*(weeks+1))
+	n := len(oc.Rotation)
+	user = oc.Rotation[((weeks%n)+n)%n]
+	return
+}
+
+//onDuty returns who is on call at now and until when, handovers take precedence over overrides and the rotation.
+//onCallMutex has to be locked
+func (monitor *Monitor) onDuty(now time.Time) (user string, until time.Time) {
+	if monitor.OnCall == nil {
+		return
+	}
+	user, _, until = monitor.OnCall.shift(now)
+	for _, overrides := range [][]*Override{monitor.handovers, monitor.OnCall.Overrides} {
+		//the latest one wins
+		for i := len(overrides) - 1; i >= 0; i-- {
+			if overrides[i].covers(now) {
+				return overrides[i].User, overrides[i].end
+			}
+		}
+	}
+	return
+}
+
+//onCall returns the username of the user on duty, "" if OnCall is not configured
+func (monitor *Monitor) onCall() string {
+	onCallMutex.Lock()
+	defer onCallMutex.Unlock()
+	user, _ := monitor.onDuty(time.Now())
+	return user
+}
+
+//resolveOnCall replaces onCallUser in usernames with the user on duty, it is dropped if nobody is on duty.
+//onDuty is the user on duty if onCallUser is in usernames
+func (monitor *Monitor) resolveOnCall(usernames []string) (resolved []string, onDuty string) {
+	resolved = make([]string, 0, len(usernames))
+	for _, u := range usernames {
+		if strings.EqualFold(u, onCallUser) {
+			u = monitor.onCall()
+			onDuty = u
+		}
+		if u != "" {
+			resolved = append(resolved, u)
+		}
+	}
+	return
+}
+
+//onCallStatus describes who is on duty for /oncall
+func (monitor *Monitor) onCallStatus() string {
+	onCallMutex.Lock()
+	defer onCallMutex.Unlock()
+	if monitor.OnCall == nil {
+		return "On-call rotation is not configured"
+	}
+	now := time.Now()
+	location := monitor.OnCall.location
+	user, until := monitor.onDuty(now)
+	lines := []string{fmt.Sprintf("On call: %s until %s", user, until.In(location).Format(localLayout+" MST"))}
+	next, _ := monitor.onDuty(until)
+	lines = append(lines, fmt.Sprintf("Next: %s", next))
+	for _, overrides := range [][]*Override{monitor.handovers, monitor.OnCall.Overrides} {
+		for _, o := range overrides {
+			if o.end.After(now) {
+				lines = append(lines, fmt.Sprintf("Override: %s from %s to %s", o.User, o.start.In(location).Format(localLayout), o.end.In(location).Format(localLayout)))
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+//handover puts the user on duty until the end of the current shift, only the user on duty or an admin can do it
+func (monitor *Monitor) handover(from string, admin bool, to string) (err error) {
+	onCallMutex.Lock()
+	defer onCallMutex.Unlock()
+	if monitor.OnCall == nil {
+		return fmt.Errorf("On-call rotation is not configured")
+	}
+	now := time.Now()
+	user, until := monitor.onDuty(now)
+	if user != from && !admin {
+		return fmt.Errorf("Only %s (on call) or an admin can hand over the shift", user)
+	}
+	if user == to {
+		return fmt.Errorf("%s is already on call", to)
+	}
+	o := &Override{User: to, Start: now.Format(time.RFC3339), End: until.Format(time.RFC3339), start: now, end: until}
+	monitor.handovers = append(monitor.handovers, o)
+	monitor.saveHandovers(now)
+	logTelegram.Infof("Shift handed over from %s to %s by %s until %s", user, to, from, o.End)
+	return
+}
+
+//saveHandovers writes handovers which are not over to handoversFile, onCallMutex has to be locked
+func (monitor *Monitor) saveHandovers(now time.Time) {
+	var active []*Override
+	for _, o := range monitor.handovers {
+		if o.end.After(now) {
+			active = append(active, o)
+		}
+	}
+	monitor.handovers = active
+	data, err := json.MarshalIndent(active, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(monitor.handoversFile, data, 0644)
+	}
+	if err != nil {
+		logTelegram.Errorf("Error saving handovers: %s", err)
+	}
+}
+
+//loadHandovers restores handovers made before restart
+func (monitor *Monitor) loadHandovers() {
+	data, err := ioutil.ReadFile(monitor.handoversFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logTelegram.Errorf("Error reading handovers: %s", err)
+		}
+		return
+	}
+	var handovers []*Override
+	err = json.Unmarshal(data, &handovers)
+	if err != nil {
+		logTelegram.Errorf("Error decoding handovers: %s", err)
+		return
+	}
+	for _, o := range handovers {
+		if o.parse(time.UTC) == nil {
+			monitor.handovers = append(monitor.handovers, o)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tb "gopkg.in/tucnak/telebot.v2"
+)
+
+const (
+	outboxSize    = 1000                  //messages kept in the outbox, the oldest ones are dropped on overflow
+	outboxMaxAge  = 24 * time.Hour        //undelivered messages are dropped after it
+	chatInterval  = time.Second           //telegram allows about one message per second to a chat
+	sendInterval  = 35 * time.Millisecond //and about 30 messages per second overall
+	maxRetryDelay = 5 * time.Minute
+	drainTimeout  = 10 * time.Second //to deliver the outbox on shutdown, the rest is sent after restart
+	saveDelay     = 2 * time.Second  //changes of the outbox are saved together by sender, at most this late
+)
+
+//outboxMutex protects outbox, outboxDirty and lastOutID
+var outboxMutex sync.Mutex
+
+//droppedAlerts counts alerts dropped because prQueue was full
+var droppedAlerts int64
+
+//queueMutex protects queueClosed: telegram handlers are not waited for on shutdown and may still queue alerts
+var queueMutex sync.Mutex
+
+//outMessage is a batch waiting to be delivered, the outbox is saved to outboxFile to survive restarts
+type outMessage struct {
+	ID        int
+	Recipient string
+	Items     []batchItem
+	Critical  bool
+	Created   time.Time
+	Attempts  int
+	NextTry   time.Time
+}
+
+//queue passes the alert to msgDispatcher without blocking. If prQueue is full, the alert is dropped,
+//unless it is critical, then the oldest queued alert is dropped instead
+func (monitor *Monitor) queue(alert Alert) {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	if monitor.queueClosed {
+		logTelegram.Warnf("Stopping, dropped: %s", alert)
+		return
+	}
+	for {
+		select {
+		case monitor.prQueue <- alert:
+			return
+		default:
+		}
+		if alert.Severity != SeverityCritical {
+			atomic.AddInt64(&droppedAlerts, 1)
+			logTelegram.Warnf("Queue is full, dropped: %s", alert)
+			return
+		}
+		select {
+		case old := <-monitor.prQueue:
+			atomic.AddInt64(&droppedAlerts, 1)
+			logTelegram.Warnf("Queue is full, dropped: %s", old)
+		default:
+		}
+	}
+}
+
+//closeQueue closes prQueue, alerts queued after it are dropped
+func (monitor *Monitor) closeQueue() {
+	queueMutex.Lock()
+	defer queueMutex.Unlock()
+	monitor.queueClosed = true
+	close(monitor.prQueue)
+}
+
+//droppedAlert reports alerts dropped since the last call, ok is false if none
+func (monitor *Monitor) droppedAlert() (alert Alert, ok bool) {
+	n := atomic.SwapInt64(&droppedAlerts, 0)
+	if n == 0 {
+		return
+	}
+	return Alert{Category: "MONITOR", Severity: SeverityWarning, Text: strconv.FormatInt(n, 10) + " alerts were dropped, the queue was full"}, true
+}
+
+//post adds a message to the outbox, if the outbox is full the oldest non-critical message is dropped
+func (monitor *Monitor) post(recipient string, items []batchItem) {
+	m := &outMessage{Recipient: recipient, Items: items, Created: time.Now()}
+	for _, item := range items {
+		if item.Severity == SeverityCritical {
+			m.Critical = true
+		}
+	}
+	outboxMutex.Lock()
+	monitor.lastOutID++
+	m.ID = monitor.lastOutID
+	monitor.outbox = append(monitor.outbox, m)
+	if len(monitor.outbox) > outboxSize {
+		drop := 0
+		for i, o := range monitor.outbox {
+			if !o.Critical {
+				drop = i
+				break
+			}
+		}
+		logTelegram.Warnf("Outbox is full, dropped a message to %s", monitor.outbox[drop].Recipient)
+		monitor.outbox = append(monitor.outbox[:drop], monitor.outbox[drop+1:]...)
+	}
+	monitor.outboxChanged()
+	outboxMutex.Unlock()
+	select {
+	case monitor.outboxReady <- struct{}{}:
+	default:
+	}
+}
+
+//nextOutMessage returns the first message of a chat which can be sent now (messages of a chat are sent in order)
+//and when to look again. outboxMutex has to be locked
+func (monitor *Monitor) nextOutMessage(now time.Time, chatNext map[string]time.Time) (next *outMessage, wake time.Time) {
+	seen := make(map[string]bool)
+	for _, m := range monitor.outbox {
+		if seen[m.Recipient] {
+			continue
+		}
+		seen[m.Recipient] = true
+		due := m.NextTry
+		if chatNext[m.Recipient].After(due) {
+			due = chatNext[m.Recipient]
+		}
+		if !due.After(now) {
+			return m, now
+		}
+		if wake.IsZero() || due.Before(wake) {
+			wake = due
+		}
+	}
+	return
+}
+
+//removeOutMessage removes a sent or dropped message, outboxMutex has to be locked
+func (monitor *Monitor) removeOutMessage(m *outMessage) {
+	for i, o := range monitor.outbox {
+		if o == m {
+			monitor.outbox = append(monitor.outbox[:i], monitor.outbox[i+1:]...)
+			break
+		}
+	}
+	monitor.outboxChanged()
+}
+
+//sender delivers the outbox, retrying with backoff and respecting telegram rate limits, until stop is closed
+//and the outbox is empty (or drainTimeout is over)
+func (monitor *Monitor) sender(stop <-chan struct{}) {
+	chatNext := make(map[string]time.Time)
+	var deadline time.Time
+	for {
+		now := time.Now()
+		outboxMutex.Lock()
+		if !monitor.outboxDirty.IsZero() && now.Sub(monitor.outboxDirty) >= saveDelay {
+			monitor.saveOutbox()
+		}
+		m, wake := monitor.nextOutMessage(now, chatNext)
+		empty := len(monitor.outbox) == 0
+		var saveAt time.Time
+		if !monitor.outboxDirty.IsZero() {
+			saveAt = monitor.outboxDirty.Add(saveDelay)
+		}
+		outboxMutex.Unlock()
+		if !deadline.IsZero() && (empty || now.After(deadline)) {
+			outboxMutex.Lock()
+			if !monitor.outboxDirty.IsZero() {
+				monitor.saveOutbox()
+			}
+			outboxMutex.Unlock()
+			return
+		}
+		if m == nil {
+			wait := time.Minute
+			if !wake.IsZero() {
+				wait = wake.Sub(now)
+			}
+			if !saveAt.IsZero() && saveAt.Sub(now) < wait {
+				wait = saveAt.Sub(now)
+			}
+			if !deadline.IsZero() && deadline.Sub(now) < wait {
+				wait = deadline.Sub(now)
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-monitor.outboxReady:
+			case <-timer.C:
+			case <-stop:
+				stop = nil
+				deadline = now.Add(drainTimeout)
+			}
+			timer.Stop()
+			continue
+		}
+		err := monitor.deliver(m)
+		now = time.Now()
+		chatNext[m.Recipient] = now.Add(chatInterval)
+		outboxMutex.Lock()
+		switch e := err.(type) {
+		case nil:
+			monitor.removeOutMessage(m)
+		case tb.FloodError:
+			logTelegram.Warnf("Rate limited by telegram, retry after %ds", e.RetryAfter)
+			m.NextTry = now.Add(time.Duration(e.RetryAfter) * time.Second)
+			chatNext[m.Recipient] = m.NextTry
+			monitor.outboxChanged()
+		case *tb.APIError:
+			//the request itself is wrong (e.g. the bot is blocked by the user), retrying won't help
+			if e.Code >= 400 && e.Code < 429 {
+				logTelegram.Errorf("Error sending message to %s, dropped: %s", m.Recipient, err)
+				monitor.removeOutMessage(m)
+				break
+			}
+			monitor.retry(m, now, err)
+		default:
+			monitor.retry(m, now, err)
+		}
+		outboxMutex.Unlock()
+		time.Sleep(sendInterval)
+	}
+}
+
+//retry schedules the next attempt with exponential backoff, outboxMutex has to be locked
+func (monitor *Monitor) retry(m *outMessage, now time.Time, err error) {
+	if now.Sub(m.Created) > outboxMaxAge {
+		logTelegram.Errorf("Error sending message to %s, dropped after %d attempts: %s", m.Recipient, m.Attempts+1, err)
+		monitor.removeOutMessage(m)
+		return
+	}
+	delay := time.Second << uint(m.Attempts)
+	if delay > maxRetryDelay || delay <= 0 {
+		delay = maxRetryDelay
+	}
+	m.Attempts++
+	m.NextTry = now.Add(delay)
+	logTelegram.Warnf("Error sending message to %s, retry in %s: %s", m.Recipient, delay, err)
+	monitor.outboxChanged()
+}
+
+//deliver renders the message (acknowledgement may have changed since it was queued) and sends it
+func (monitor *Monitor) deliver(m *outMessage) error {
+	ackMutex.Lock()
+	text, markup := monitor.render(m.Items)
+	ackMutex.Unlock()
+	var options []interface{}
+	if markup != nil {
+		options = append(options, markup)
+	}
+	sent, err := monitor.bot.Send(subscriber(m.Recipient), text, options...)
+	if err != nil {
+		return err
+	}
+	if markup != nil {
+		b := &batch{Message: tb.StoredMessage{MessageID: strconv.Itoa(sent.ID), ChatID: sent.Chat.ID}, Items: m.Items}
+		ackMutex.Lock()
+		monitor.batches[messageKey(b.Message)] = b
+		monitor.saveSentAlerts()
+		ackMutex.Unlock()
+	}
+	return nil
+}
+
+//outboxChanged schedules saving the outbox: it is rewritten as a whole, so changes made during an alert storm
+//are saved together. outboxMutex has to be locked
+func (monitor *Monitor) outboxChanged() {
+	if monitor.outboxDirty.IsZero() {
+		monitor.outboxDirty = time.Now()
+	}
+}
+
+//saveOutbox writes the outbox to outboxFile, outboxMutex has to be locked
+func (monitor *Monitor) saveOutbox() {
+	monitor.outboxDirty = time.Time{}
+	data, err := json.MarshalIndent(monitor.outbox, "", "  ")
+	if err != nil {
+		logTelegram.Errorf("Error encoding outbox: %s", err)
+		return
+	}
+	tmp := monitor.outboxFile + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, monitor.outboxFile)
+	}
+	if err != nil {
+		logTelegram.Errorf("Error saving outbox: %s", err)
+	}
+}
+
+//loadOutbox restores messages which were not delivered before restart
+func (monitor *Monitor) loadOutbox() {
+	data, err := ioutil.ReadFile(monitor.outboxFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logTelegram.Errorf("Error reading outbox: %s", err)
+		}
+		return
+	}
+	err = json.Unmarshal(data, &monitor.outbox)
+	if err != nil {
+		logTelegram.Errorf("Error decoding outbox: %s", err)
+		return
+	}
+	for _, m := range monitor.outbox {
+		if m.ID > monitor.lastOutID {
+			monitor.lastOutID = m.ID
+		}
+	}
+	if len(monitor.outbox) > 0 {
+		logTelegram.Infof("Loaded %d undelivered messages", len(monitor.outbox))
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+//stateMutex serializes writes of stateFile
+var stateMutex sync.Mutex
+
+//savedMetric is the alert state of a check kept across restarts
+type savedMetric struct {
+	LastSeverity Severity
+	Value        float64
+	AlertSince   time.Time
+	LastSent     time.Time
+	LastMessage  string
+	MsgStatus    string
+	AckedBy      string
+	Broken       bool
+	Failure      string
+	AdnlChanged  bool
+}
+
+//savedLogEvent is the alert state of a log event kept across restarts
+type savedLogEvent struct {
+	LastState   bool
+	AlertSince  time.Time
+	LastSent    time.Time
+	LastMessage string
+	AckedBy     string
+	Events      []time.Time //within the window
+}
+
+//savedState is the content of stateFile
+type savedState struct {
+	Saved     time.Time
+	Checks    map[string]*savedMetric
+	LogEvents map[string]*savedLogEvent //by alertKey()
+}
+
+//saveState writes the alert state of all checks and log events to stateFile
+func (monitor *Monitor) saveState() {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	state := savedState{Saved: time.Now(), Checks: make(map[string]*savedMetric), LogEvents: make(map[string]*savedLogEvent)}
+	checksMutex.RLock()
+	for _, checks := range []map[string]*Metric{monitor.Checks, monitor.ExtChecks} {
+		for name, metric := range checks {
+			metric.Lock()
+			state.Checks[name] = &savedMetric{
+				LastSeverity: metric.lastSeverity,
+				Value:        metric.value,
+				AlertSince:   metric.alertSince,
+				LastSent:     metric.lastSent,
+				LastMessage:  metric.lastMessage,
+				MsgStatus:    metric.msgStatus,
+				AckedBy:      metric.ackedBy,
+				Broken:       metric.lastBroken,
+				Failure:      metric.failure,
+				AdnlChanged:  metric.adnlChanged,
+			}
+			metric.Unlock()
+		}
+	}
+	for _, l := range monitor.Logfiles {
+		for k := range l.Events {
+			entry := &l.Events[k]
+			entry.Lock()
+			saved := &savedLogEvent{
+				LastState:   entry.lastState,
+				AlertSince:  entry.alertSince,
+				LastSent:    entry.lastSent,
+				LastMessage: entry.lastMessage,
+				AckedBy:     entry.ackedBy,
+			}
+			for _, e := range entry.events {
+				saved.Events = append(saved.Events, e.eventTS)
+			}
+			entry.Unlock()
+			state.LogEvents[entry.key] = saved
+		}
+	}
+	checksMutex.RUnlock()
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		logMain.Errorf("Error encoding state: %s", err)
+		return
+	}
+	tmp := monitor.stateFile + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err == nil {
+		err = os.Rename(tmp, monitor.stateFile)
+	}
+	if err != nil {
+		logMain.Errorf("Error saving state: %s", err)
+	}
+}
+
+//loadState restores the alert state saved before restart, call it before the checks and checker() start.
+//An alert which cleared while ftvmon was stopped is reported as cleared after the first measurement
+func (monitor *Monitor) loadState() {
+	data, err := ioutil.ReadFile(monitor.stateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logMain.Errorf("Error reading state: %s", err)
+		}
+		return
+	}
+	var state savedState
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		logMain.Errorf("Error decoding state: %s", err)
+		return
+	}
+	for _, checks := range []map[string]*Metric{monitor.Checks, monitor.ExtChecks} {
+		for name, metric := range checks {
+			saved, found := state.Checks[name]
+			if !found {
+				continue
+			}
+			metric.lastSeverity = saved.LastSeverity
+			metric.severity = saved.LastSeverity
+			metric.value = saved.Value
+			metric.alertSince = saved.AlertSince
+			metric.lastSent = saved.LastSent
+			metric.lastMessage = saved.LastMessage
+			metric.msgStatus = saved.MsgStatus
+			metric.ackedBy = saved.AckedBy
+			metric.lastBroken = saved.Broken
+			metric.broken = saved.Broken
+			metric.failure = saved.Failure
+			metric.adnlChanged = saved.AdnlChanged
+		}
+	}
+	for _, l := range monitor.Logfiles {
+		for k := range l.Events {
+			entry := &l.Events[k]
+			saved, found := state.LogEvents[entry.key]
+			if !found {
+				continue
+			}
+			entry.lastState = saved.LastState
+			entry.alertSince = saved.AlertSince
+			entry.lastSent = saved.LastSent
+			entry.lastMessage = saved.LastMessage
+			entry.ackedBy = saved.AckedBy
+			for _, ts := range saved.Events {
+				entry.events = append(entry.events, logRecord{eventTS: ts})
+			}
+		}
+	}
+	logMain.Infof("Loaded alert state saved at %s", state.Saved.Format(time.RFC3339))
+}
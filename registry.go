@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+//Check is a single metric, Run takes one measurement and returns its result
+type Check interface {
+	Name() string
+	Interval() time.Duration
+	Run(ctx context.Context) (Result, error)
+}
+
+//Result of a single measurement
+type Result struct {
+	Severity  Severity //SeverityOK if the metric is not in alert
+	Value     float64  //measured value, 0 for checks without a numeric value
+	Message   string   //sent to subscribers if Severity changed, without the category and severity prefix
+	MsgStatus string   //reported by /status
+}
+
+//errFirstSample is returned by rate-based checks, which need two samples to get a result
+var errFirstSample = errors.New("first sample")
+
+//checkFactory creates a check for the metric configured under base.name
+type checkFactory func(base *baseCheck) Check
+
+type registration struct {
+	category string
+	factory  checkFactory
+}
+
+var registry = make(map[string]registration)
+
+//registerCheck makes a check available by name in conf.json, call it from init().
+//Category prefixes all the alerts of the check, e.g. "DISK".
+func registerCheck(name string, category string, factory checkFactory) {
+	if _, found := registry[name]; found {
+		panic(fmt.Sprintf("check %s is already registered", name))
+	}
+	registry[name] = registration{category, factory}
+}
+
+//baseCheck holds everything a check needs, embed it to satisfy Name() and Interval()
+type baseCheck struct {
+	name     string
+	interval time.Duration
+	monitor  *Monitor
+	metric   *Metric
+}
+
+func (c *baseCheck) Name() string {
+	return c.name
+}
+
+func (c *baseCheck) Interval() time.Duration {
+	return c.interval
+}
+
+func registeredChecks() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//validateChecks returns an error if conf.json refers to a check which is not registered
+//or has an invalid Interval, For, ClearFor or RepeatEvery, sets the name and the parsed durations of every metric
+func (monitor *Monitor) validateChecks() (err error) {
+	groups := []struct {
+		checks   map[string]*Metric
+		interval time.Duration
+	}{
+		{monitor.Checks, time.Duration(checksInterval) * time.Second},
+		{monitor.ExtChecks, time.Duration(extChecksInterval) * time.Second},
+	}
+	for _, group := range groups {
+		for name, metric := range group.checks {
+			r, found := registry[name]
+			if !found {
+				err = fmt.Errorf("Unknown check %s in conf, available checks: %v", name, registeredChecks())
+				return
+			}
+			metric.name = name
+			metric.category = r.category
+			metric.interval = group.interval
+			if metric.Interval != "" {
+				metric.interval, err = time.ParseDuration(metric.Interval)
+				if err != nil || metric.interval <= 0 {
+					err = fmt.Errorf("Invalid Interval %q of check %s", metric.Interval, name)
+					return
+				}
+			}
+			metric.forAlert, err = parseHold(metric.For)
+			if err != nil {
+				err = fmt.Errorf("Invalid For %q of check %s: %s", metric.For, name, err)
+				return
+			}
+			metric.clearFor, err = parseHold(metric.ClearFor)
+			if err != nil {
+				err = fmt.Errorf("Invalid ClearFor %q of check %s: %s", metric.ClearFor, name, err)
+				return
+			}
+			metric.repeatEvery, err = parseRepeat(metric.RepeatEvery)
+			if err != nil {
+				err = fmt.Errorf("Invalid RepeatEvery %q of check %s", metric.RepeatEvery, name)
+				return
+			}
+		}
+	}
+	return
+}
+
+func (monitor *Monitor) newCheck(metric *Metric) Check {
+	return registry[metric.name].factory(&baseCheck{
+		name:     metric.name,
+		interval: metric.interval,
+		monitor:  monitor,
+		metric:   metric,
+	})
+}
+
+//notify passes the updated metric to checker()
+func (monitor *Monitor) notify(ctx context.Context, metric *Metric) {
+	select {
+	case monitor.updates <- metric:
+	case <-ctx.Done():
+	}
+}
+
+//runCheck runs the check every check.Interval(), until it fails or ctx is done
+func (monitor *Monitor) runCheck(ctx context.Context, check Check, metric *Metric) error {
+	ticker := time.NewTicker(check.Interval())
+	defer ticker.Stop()
+	for {
+		result, err := safeRun(ctx, check)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil && err != errFirstSample {
+			return err
+		}
+		if err == nil {
+			metric.Lock()
+			metric.broken = false
+			metric.severity = result.Severity
+			metric.value = result.Value
+			metric.updated = time.Now()
+			metric.message = result.Message
+			metric.msgStatus = result.MsgStatus
+			metric.Unlock()
+			monitor.notify(ctx, metric)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
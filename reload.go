@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+//checksMutex protects Checks, ExtChecks, Logfiles, TonPath, KeysPath and Node, which are replaced on reload.
+//Checks get the node config through node()
+var checksMutex sync.RWMutex
+
+//reloadMutex serializes reloads coming from SIGHUP and /reload
+var reloadMutex sync.Mutex
+
+//runner tracks the goroutines of a single check or log file, so they can be stopped on reload
+type runner struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newRunner(ctx context.Context) (context.Context, *runner) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &runner{cancel: cancel}
+}
+
+//start runs f in a goroutine, f has to call wg.Done() when it exits
+func (r *runner) start(f func()) {
+	wg.Add(1)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		f()
+	}()
+}
+
+func (r *runner) stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+//readConfig decodes and validates the config file
+func readConfig(file string) (config *Monitor, err error) {
+	configFile, err := os.Open(file)
+	if err != nil {
+		err = fmt.Errorf("No config file: %s", err)
+		return
+	}
+	defer configFile.Close()
+	config = new(Monitor)
+	decoder := json.NewDecoder(configFile)
+	err = decoder.Decode(config)
+	if err != nil {
+		err = fmt.Errorf("Error decoding config file: %s", err)
+		return
+	}
+	err = config.validateChecks()
+	if err != nil {
+		err = fmt.Errorf("Error in config file: %s", err)
+		return
+	}
+	if config.TonPath != "" {
+		config.TonPath = filepath.Clean(config.TonPath)
+	}
+	if config.KeysPath != "" {
+		config.KeysPath = filepath.Clean(config.KeysPath)
+	}
+	if config.Node == nil {
+		config.Node = &Node{}
+	}
+	err = config.Node.parse()
+	if err != nil {
+		err = fmt.Errorf("Error in config file: %s", err)
+		return
+	}
+	for _, m := range config.Maintenance {
+		err = m.parse()
+		if err != nil {
+			err = fmt.Errorf("Error in config file: %s", err)
+			return
+		}
+		for i, name := range m.Checks {
+			m.Checks[i], err = config.muteTarget(name)
+			if err != nil {
+				err = fmt.Errorf("Error in config file, maintenance: %s", err)
+				return
+			}
+		}
+	}
+	if config.OnCall != nil {
+		err = config.OnCall.parse()
+		if err != nil {
+			err = fmt.Errorf("Error in config file: %s", err)
+			return
+		}
+	}
+	if config.BatchWindow != "" {
+		config.batchWindow, err = time.ParseDuration(config.BatchWindow)
+		if err != nil || config.batchWindow < 0 {
+			err = fmt.Errorf("Error in config file: invalid BatchWindow %q", config.BatchWindow)
+			return
+		}
+	}
+	if config.HTTP != nil && config.HTTP.Listen == "" {
+		err = fmt.Errorf("Error in config file: HTTP Listen is empty")
+		return
+	}
+	if config.Agent != nil && config.Server != nil {
+		err = fmt.Errorf("Error in config file: Agent and Server are exclusive")
+		return
+	}
+	if config.Agent != nil {
+		err = config.Agent.parse()
+		if err != nil {
+			err = fmt.Errorf("Error in config file: %s", err)
+			return
+		}
+	}
+	if config.Server != nil {
+		err = config.Server.parse()
+		if err != nil {
+			err = fmt.Errorf("Error in config file: %s", err)
+			return
+		}
+	}
+	if config.Zabbix != nil {
+		err = config.Zabbix.parse()
+		if err != nil {
+			err = fmt.Errorf("Error in config file: %s", err)
+			return
+		}
+	}
+	err = config.Logging.parse()
+	if err != nil {
+		err = fmt.Errorf("Error in config file: %s", err)
+		return
+	}
+	for _, tier := range config.Escalation {
+		err = tier.parse(config.OnCall != nil)
+		if err != nil {
+			err = fmt.Errorf("Error in config file: %s", err)
+			return
+		}
+	}
+	for _, l := range config.Logfiles {
+		for k := range l.Events {
+			l.Events[k].key = l.File + ": " + l.Events[k].Match
+			l.Events[k].severity, err = parseSeverity(l.Events[k].Severity)
+			if err != nil {
+				err = fmt.Errorf("Error in config file, event %s: %s", l.Events[k].Match, err)
+				return
+			}
+			l.Events[k].repeatEvery, err = parseRepeat(l.Events[k].RepeatEvery)
+			if err != nil {
+				err = fmt.Errorf("Error in config file, event %s: invalid RepeatEvery %q", l.Events[k].Match, l.Events[k].RepeatEvery)
+				return
+			}
+			if l.Events[k].Enabled && l.Events[k].IsRegex {
+				logLogs.Debugf("Compiling regex %s...", l.Events[k].Match)
+				l.Events[k].re, err = regexp.Compile(l.Events[k].Match)
+				if err != nil {
+					logLogs.Errorf("Failed to compile regex %s, removed the event from checking: %s", l.Events[k].Match, err)
+					l.Events[k].Enabled = false
+					err = nil
+				}
+			}
+		}
+	}
+	return
+}
+
+//sameConfig compares exported (configured) fields of a and b
+func sameConfig(a interface{}, b interface{}) bool {
+	aj, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bj, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aj, bj)
+}
+
+func (monitor *Monitor) startCheck(ctx context.Context, metric *Metric) {
+	ctx, r := newRunner(ctx)
+	monitor.running[metric] = r
+	r.start(func() { monitor.superviseCheck(ctx, metric) })
+}
+
+func (monitor *Monitor) startChecks(ctx context.Context) {
+	for _, checks := range []map[string]*Metric{monitor.Checks, monitor.ExtChecks} {
+		for _, metric := range checks {
+			if metric.Enabled {
+				monitor.startCheck(ctx, metric)
+			}
+		}
+	}
+}
+
+func (monitor *Monitor) startLogfile(ctx context.Context, logfile *Logfile) {
+	if !logfile.Enabled {
+		return
+	}
+	ctx, r := newRunner(ctx)
+	monitor.running[logfile] = r
+	for k := range logfile.Events {
+		entry := &logfile.Events[k]
+		if entry.Enabled {
+			entry.Lock()
+			entry.eventQueue = make(chan string)
+			entry.Unlock()
+			r.start(func() { monitor.logWorker(ctx, entry) })
+		}
+	}
+	logLogs.Infof("Launching a goroutine for %s...", logfile.File)
+	r.start(func() { monitor.tailLog(ctx, logfile) })
+}
+
+func (monitor *Monitor) stop(item interface{}) {
+	if r, found := monitor.running[item]; found {
+		r.stop()
+		delete(monitor.running, item)
+	}
+}
+
+//reload re-reads conf.json and restarts only the checks and log files whose config has changed.
+//Alert state is kept for every check and log event which is still configured.
+func (monitor *Monitor) reload(ctx context.Context) (err error) {
+	reloadMutex.Lock()
+	defer reloadMutex.Unlock()
+	config, err := readConfig(monitor.configFile)
+	if err != nil {
+		return
+	}
+	if config.Token != monitor.Token {
+		logMain.Warnf("Token has changed, restart to apply")
+	}
+	if config.StateDir != monitor.StateDir {
+		logMain.Warnf("StateDir has changed, restart to apply")
+	}
+	if !sameConfig(config.HTTP, monitor.HTTP) {
+		logMain.Warnf("HTTP has changed, restart to apply")
+	}
+	if !sameConfig(config.Zabbix, monitor.Zabbix) {
+		logMain.Warnf("Zabbix has changed, restart to apply")
+	}
+	if !sameConfig(config.Agent, monitor.Agent) || !sameConfig(config.Server, monitor.Server) {
+		logMain.Warnf("Agent or Server has changed, restart to apply")
+	}
+	err = setupLogging(config.Logging)
+	if err != nil {
+		return
+	}
+	monitor.Logging = config.Logging
+	//ExtChecks depend on the node and its paths
+	pathsChanged := config.TonPath != monitor.TonPath || config.KeysPath != monitor.KeysPath || !sameConfig(config.Node, monitor.Node)
+	if pathsChanged {
+		logMain.Infof("Node or its paths have changed, restarting ExtChecks")
+	}
+
+	//checks are stopped first, as a running check may need checksMutex
+	var started []func()
+	diffChecks := func(running map[string]*Metric, checks map[string]*Metric, restartAll bool) {
+		for name, metric := range running {
+			newMetric, found := checks[name]
+			if !found {
+				logMain.Infof("Check %s is removed", name)
+			}
+			if !found || restartAll || !sameConfig(metric, newMetric) {
+				monitor.stop(metric)
+			}
+		}
+		for name, m := range checks {
+			newMetric := m
+			metric, found := running[name]
+			if found && !restartAll && sameConfig(metric, newMetric) {
+				checks[name] = metric
+				continue
+			}
+			if found {
+				metric.Lock()
+				newMetric.carryState(metric)
+				metric.Unlock()
+				if newMetric.Enabled {
+					logMain.Infof("Check %s has changed, restarting it", name)
+				} else {
+					logMain.Infof("Check %s is disabled", name)
+				}
+			}
+			if newMetric.Enabled {
+				started = append(started, func() { monitor.startCheck(ctx, newMetric) })
+			}
+		}
+	}
+	diffChecks(monitor.Checks, config.Checks, false)
+	diffChecks(monitor.ExtChecks, config.ExtChecks, pathsChanged)
+
+	logfiles := make([]*Logfile, 0, len(config.Logfiles))
+	kept := make(map[*Logfile]bool)
+	replaced := make(map[*Logfile]bool)
+	for _, l := range config.Logfiles {
+		logfile := l
+		var old *Logfile
+		for _, o := range monitor.Logfiles {
+			if o.File == logfile.File {
+				old = o
+				break
+			}
+		}
+		if old != nil && sameConfig(old, logfile) {
+			kept[old] = true
+			logfiles = append(logfiles, old)
+			continue
+		}
+		if old != nil {
+			logMain.Infof("Config for %s has changed", logfile.File)
+			monitor.stop(old)
+			logfile.carryState(old)
+			replaced[old] = true
+		}
+		logfiles = append(logfiles, logfile)
+		started = append(started, func() { monitor.startLogfile(ctx, logfile) })
+	}
+	for _, old := range monitor.Logfiles {
+		if !kept[old] {
+			if !replaced[old] {
+				logMain.Infof("Log file %s is removed", old.File)
+			}
+			monitor.stop(old)
+		}
+	}
+
+	checksMutex.Lock()
+	monitor.Checks = config.Checks
+	monitor.ExtChecks = config.ExtChecks
+	monitor.TonPath = config.TonPath
+	monitor.KeysPath = config.KeysPath
+	monitor.Node = config.Node
+	monitor.Logfiles = logfiles
+	checksMutex.Unlock()
+	mutex.Lock()
+	monitor.Authorized = config.Authorized
+	monitor.Admins = config.Admins
+	monitor.NotifyStop = config.NotifyStop
+	mutex.Unlock()
+	muteMutex.Lock()
+	monitor.Maintenance = config.Maintenance
+	muteMutex.Unlock()
+	ackMutex.Lock()
+	monitor.Escalation = config.Escalation
+	monitor.BatchWindow = config.BatchWindow
+	monitor.batchWindow = config.batchWindow
+	ackMutex.Unlock()
+	onCallMutex.Lock()
+	monitor.OnCall = config.OnCall
+	onCallMutex.Unlock()
+	for _, f := range started {
+		f()
+	}
+	logMain.Infof("Config reloaded")
+	return
+}
+
+//carryState copies run-time state of a metric which config has changed
+func (metric *Metric) carryState(old *Metric) {
+	metric.message = old.message
+	metric.msgStatus = old.msgStatus
+	metric.adnlChanged = old.adnlChanged
+	metric.lastBlockTime = old.lastBlockTime
+	metric.lastSeverity = old.lastSeverity
+	metric.severity = old.severity
+	metric.value = old.value
+	metric.updated = old.updated
+	metric.failure = old.failure
+	metric.lastBroken = old.lastBroken
+	metric.broken = old.broken
+	metric.pendingSince = old.pendingSince
+	metric.pendingSamples = old.pendingSamples
+	metric.pendingSeverity = old.pendingSeverity
+	metric.alertSince = old.alertSince
+	metric.lastSent = old.lastSent
+	metric.lastMessage = old.lastMessage
+	metric.ackedBy = old.ackedBy
+}
+
+//carryState copies events and state of log events which config has not changed
+func (logfile *Logfile) carryState(old *Logfile) {
+	for k := range logfile.Events {
+		for n := range old.Events {
+			if sameConfig(&logfile.Events[k], &old.Events[n]) {
+				logfile.Events[k].events = old.Events[n].events
+				logfile.Events[k].lastState = old.Events[n].lastState
+				logfile.Events[k].alertSince = old.Events[n].alertSince
+				logfile.Events[k].lastSent = old.Events[n].lastSent
+				logfile.Events[k].lastMessage = old.Events[n].lastMessage
+				logfile.Events[k].ackedBy = old.Events[n].ackedBy
+				logfile.Events[k].matched = old.Events[n].matched
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+//hold is how long a new state has to persist before it is reported
+type hold struct {
+	samples  int
+	duration time.Duration
+}
+
+//parseHold parses a number of samples ("3") or a Go duration ("2m"), "" means no delay
+func parseHold(s string) (h hold, err error) {
+	if s == "" {
+		return
+	}
+	if h.samples, err = strconv.Atoi(s); err == nil {
+		if h.samples < 0 {
+			err = fmt.Errorf("negative number of samples")
+		}
+		return
+	}
+	h.duration, err = time.ParseDuration(s)
+	if err == nil && h.duration < 0 {
+		err = fmt.Errorf("negative duration")
+	}
+	return
+}
+
+//parseRepeat parses RepeatEvery, "" means do not repeat
+func parseRepeat(s string) (d time.Duration, err error) {
+	if s == "" {
+		return
+	}
+	d, err = time.ParseDuration(s)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("non-positive duration")
+	}
+	return
+}
+
+func (h hold) reached(samples int, since time.Time) bool {
+	return samples >= h.samples && time.Since(since) >= h.duration
+}
+
+//critical returns the critical threshold, Threshold if Critical is not set
+func (metric *Metric) critical() float64 {
+	if metric.Critical != nil {
+		return *metric.Critical
+	}
+	return metric.Threshold
+}
+
+//lowest returns the threshold of the lowest alert level configured
+func (metric *Metric) lowest() float64 {
+	if metric.Warning != nil {
+		return *metric.Warning
+	}
+	return metric.critical()
+}
+
+//severityAbove returns the severity of a value for metrics alerting on high values
+//and the threshold crossed (the lowest one for SeverityOK)
+func (metric *Metric) severityAbove(value float64) (Severity, float64) {
+	if value >= metric.critical() {
+		return SeverityCritical, metric.critical()
+	}
+	if metric.Warning != nil && value >= *metric.Warning {
+		return SeverityWarning, *metric.Warning
+	}
+	return SeverityOK, metric.lowest()
+}
+
+//severityBelow returns the severity of a value for metrics alerting on low values
+//and the threshold crossed (the lowest one for SeverityOK)
+func (metric *Metric) severityBelow(value float64) (Severity, float64) {
+	if value <= metric.critical() {
+		return SeverityCritical, metric.critical()
+	}
+	if metric.Warning != nil && value <= *metric.Warning {
+		return SeverityWarning, *metric.Warning
+	}
+	return SeverityOK, metric.lowest()
+}
+
+//isCleared tells if the value is far enough from the lowest alert threshold to clear the alert.
+//ClearThreshold below the threshold means higher values are bad, above it - lower values are bad.
+func (metric *Metric) isCleared() bool {
+	if metric.ClearThreshold == nil {
+		return true
+	}
+	if *metric.ClearThreshold <= metric.lowest() {
+		return metric.value < *metric.ClearThreshold
+	}
+	return metric.value > *metric.ClearThreshold
+}
+
+//nextSeverity returns the severity to be reported after the last measurement and true if it has to be reported now
+func (metric *Metric) nextSeverity() (severity Severity, changed bool) {
+	severity = metric.severity
+	if severity == SeverityOK && metric.lastSeverity != SeverityOK && !metric.isCleared() {
+		severity = metric.lastSeverity
+	}
+	if severity == metric.lastSeverity {
+		metric.pendingSamples = 0
+		return
+	}
+	if metric.pendingSamples == 0 || severity != metric.pendingSeverity {
+		metric.pendingSince = time.Now()
+		metric.pendingSeverity = severity
+		metric.pendingSamples = 0
+	}
+	metric.pendingSamples++
+	h := metric.clearFor
+	if severity > metric.lastSeverity {
+		h = metric.forAlert
+	}
+	if !h.reached(metric.pendingSamples, metric.pendingSince) {
+		return
+	}
+	metric.pendingSamples = 0
+	changed = true
+	return
+}
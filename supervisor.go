@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+//maxBackoff limits the delay between restarts of a failed check
+const maxBackoff = 10 * time.Minute
+
+//superviseCheck runs the check and restarts it with exponential backoff every time it fails.
+//A failed check is marked as broken, its status (alert or not) is kept as it was.
+func (monitor *Monitor) superviseCheck(ctx context.Context, metric *Metric) {
+	defer wg.Done()
+	backoff := metric.interval
+	for {
+		started := time.Now()
+		err := monitor.runCheck(ctx, monitor.newCheck(metric), metric)
+		if err == nil {
+			return
+		}
+		//the check has been working for a while, start over with the shortest delay
+		if time.Since(started) > 2*backoff {
+			backoff = metric.interval
+		}
+		logChecks.With("check", metric.name).Warnf("Check %s failed: %s, restarting in %s", metric.name, err, backoff)
+		metric.Lock()
+		metric.broken = true
+		metric.failure = err.Error()
+		metric.msgStatus = err.Error()
+		metric.Unlock()
+		monitor.notify(ctx, metric)
+		if sleep(ctx, backoff) != nil {
+			return
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+//safeRun converts a panic in check.Run into an error, so that the check can be restarted
+func safeRun(ctx context.Context, check Check) (result Result, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s: panic: %v", check.Name(), r)
+		}
+	}()
+	return check.Run(ctx)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	zabbixTimeout      = 10 * time.Second
+	zabbixMaxResponse  = 1 << 20
+	checksDiscoveryKey = "ftvmon.checks.discovery"
+	logsDiscoveryKey   = "ftvmon.logs.discovery"
+)
+
+//Zabbix configures sending of check values and alert states to a Zabbix server or proxy (trapper items)
+type Zabbix struct {
+	Server            string //"zabbix.example.com:10051", the port defaults to 10051
+	Host              string //host name in Zabbix, the hostname if empty
+	Interval          string //Go duration, 1m if not set
+	DiscoveryInterval string //Go duration, low-level discovery data is re-sent after it or when checks change, 1h if not set
+	interval          time.Duration
+	discoveryInterval time.Duration
+}
+
+func (z *Zabbix) parse() (err error) {
+	if z.Server == "" {
+		return fmt.Errorf("Zabbix Server is empty")
+	}
+	if _, _, e := net.SplitHostPort(z.Server); e != nil {
+		z.Server = net.JoinHostPort(z.Server, "10051")
+	}
+	z.interval, z.discoveryInterval = time.Minute, time.Hour
+	if z.Interval != "" {
+		z.interval, err = time.ParseDuration(z.Interval)
+		if err != nil || z.interval <= 0 {
+			return fmt.Errorf("Invalid Zabbix Interval %q", z.Interval)
+		}
+	}
+	if z.DiscoveryInterval != "" {
+		z.discoveryInterval, err = time.ParseDuration(z.DiscoveryInterval)
+		if err != nil || z.discoveryInterval <= 0 {
+			return fmt.Errorf("Invalid Zabbix DiscoveryInterval %q", z.DiscoveryInterval)
+		}
+	}
+	return
+}
+
+//zabbixItem is a value of a trapper item
+type zabbixItem struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+}
+
+type zabbixRequest struct {
+	Request string       `json:"request"`
+	Data    []zabbixItem `json:"data"`
+	Clock   int64        `json:"clock"`
+}
+
+type zabbixResponse struct {
+	Response string `json:"response"`
+	Info     string `json:"info"`
+}
+
+var zabbixFailed = regexp.MustCompile(`failed: (\d+)`)
+
+//zabbixKey formats an item key with quoted parameters, e.g. ftvmon.log.matches["/var/log/x.log","error"]
+func zabbixKey(key string, params ...string) string {
+	quoted := make([]string, len(params))
+	for i, p := range params {
+		quoted[i] = `"` + strings.ReplaceAll(p, `"`, `\"`) + `"`
+	}
+	return key + "[" + strings.Join(quoted, ",") + "]"
+}
+
+//zabbixDiscovery returns low-level discovery data of the enabled checks and log events
+func zabbixDiscovery(checks []checkSample, events []logEventSample) (checksLLD string, logsLLD string) {
+	type lld struct {
+		Data []map[string]string `json:"data"`
+	}
+	c := lld{Data: []map[string]string{}}
+	for _, check := range checks {
+		if check.enabled {
+			c.Data = append(c.Data, map[string]string{"{#CHECK}": check.name, "{#CATEGORY}": check.category})
+		}
+	}
+	l := lld{Data: []map[string]string{}}
+	for _, e := range events {
+		if e.enabled {
+			l.Data = append(l.Data, map[string]string{"{#FILE}": e.file, "{#MATCH}": e.match})
+		}
+	}
+	data, _ := json.Marshal(c)
+	checksLLD = string(data)
+	data, _ = json.Marshal(l)
+	logsLLD = string(data)
+	return
+}
+
+//zabbixItems returns values of the item prototypes of the enabled checks and log events
+func zabbixItems(host string, now time.Time, checks []checkSample, events []logEventSample) (items []zabbixItem) {
+	add := func(key string, value string, params ...string) {
+		items = append(items, zabbixItem{Host: host, Key: zabbixKey(key, params...), Value: value, Clock: now.Unix()})
+	}
+	flag := func(b bool) string {
+		return strconv.Itoa(int(boolValue(b)))
+	}
+	for _, c := range checks {
+		if !c.enabled {
+			continue
+		}
+		if !c.updated.IsZero() {
+			add("ftvmon.check.value", strconv.FormatFloat(c.value, 'f', -1, 64), c.name)
+		}
+		add("ftvmon.check.severity", strconv.Itoa(int(c.severity)), c.name)
+		add("ftvmon.check.failing", flag(c.failing), c.name)
+		add("ftvmon.check.acknowledged", flag(c.ackedBy != ""), c.name)
+		add("ftvmon.check.muted", flag(c.muted), c.name)
+		if c.status != "" {
+			add("ftvmon.check.status", c.status, c.name)
+		}
+	}
+	for _, e := range events {
+		if !e.enabled {
+			continue
+		}
+		add("ftvmon.log.matches", strconv.FormatUint(e.matched, 10), e.file, e.match)
+		add("ftvmon.log.count", strconv.Itoa(e.window), e.file, e.match)
+		add("ftvmon.log.alert", flag(e.alert), e.file, e.match)
+	}
+	return
+}
+
+//zabbixSend sends the items with the sender protocol and returns the number of items the server failed to process
+func zabbixSend(ctx context.Context, server string, items []zabbixItem) (failed int, err error) {
+	body, err := json.Marshal(zabbixRequest{Request: "sender data", Data: items, Clock: time.Now().Unix()})
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, zabbixTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", server)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	//"ZBXD", protocol version 1, data length (8 bytes, little endian), data
+	var packet bytes.Buffer
+	packet.WriteString("ZBXD\x01")
+	binary.Write(&packet, binary.LittleEndian, uint64(len(body)))
+	packet.Write(body)
+	_, err = conn.Write(packet.Bytes())
+	if err != nil {
+		return
+	}
+	header := make([]byte, 13)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return
+	}
+	if string(header[:4]) != "ZBXD" {
+		return 0, fmt.Errorf("Invalid response from Zabbix")
+	}
+	size := binary.LittleEndian.Uint64(header[5:])
+	if size > zabbixMaxResponse {
+		return 0, fmt.Errorf("Zabbix response is too big: %d bytes", size)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(conn, int64(size)))
+	if err != nil {
+		return
+	}
+	var response zabbixResponse
+	err = json.Unmarshal(data, &response)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid response from Zabbix: %s", err)
+	}
+	if response.Response != "success" {
+		return 0, fmt.Errorf("Zabbix response: %s %s", response.Response, response.Info)
+	}
+	if m := zabbixFailed.FindStringSubmatch(response.Info); m != nil {
+		failed, _ = strconv.Atoi(m[1])
+	}
+	return
+}
+
+//pushToZabbix makes zabbixSender send the values now, a push which is already pending covers this one
+func (monitor *Monitor) pushToZabbix() {
+	select {
+	case monitor.zabbixPush <- struct{}{}:
+	default:
+	}
+}
+
+//zabbixSender sends discovery data and item values to Zabbix every Interval and when alert state changes,
+//until ctx is done
+func (monitor *Monitor) zabbixSender(ctx context.Context) {
+	defer wg.Done()
+	z := monitor.Zabbix
+	host := z.Host
+	if host == "" {
+		host = monitor.hostname
+	}
+	zlog := logMain.With("server", z.Server)
+	var lastDiscovery time.Time
+	var sentChecks, sentLogs string
+	ticker := time.NewTicker(z.interval)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		checks, events := monitor.samples()
+		checksLLD, logsLLD := zabbixDiscovery(checks, events)
+		//items of new checks can't be received until Zabbix processes the discovery data, the values of the others are sent anyway
+		if checksLLD != sentChecks || logsLLD != sentLogs || now.Sub(lastDiscovery) >= z.discoveryInterval {
+			_, err := zabbixSend(ctx, z.Server, []zabbixItem{
+				{Host: host, Key: checksDiscoveryKey, Value: checksLLD, Clock: now.Unix()},
+				{Host: host, Key: logsDiscoveryKey, Value: logsLLD, Clock: now.Unix()},
+			})
+			if err != nil {
+				zlog.Warnf("Error sending discovery data to Zabbix: %s", err)
+			} else {
+				lastDiscovery = now
+				sentChecks, sentLogs = checksLLD, logsLLD
+			}
+		}
+		failed, err := zabbixSend(ctx, z.Server, zabbixItems(host, now, checks, events))
+		if err != nil {
+			zlog.Warnf("Error sending to Zabbix: %s", err)
+		} else if failed > 0 {
+			zlog.Debugf("Zabbix failed to process %d items", failed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-monitor.zabbixPush:
+		}
+	}
+}